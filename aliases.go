@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// aliases let people be reached by other names, eg, mentioning
+// 'anders' gets to 'thraxil'. the "aliases" bucket maps each
+// (lowercased) alias to the nick that owns it
+
+var errAliasTaken = errors.New("someone else already goes by that")
+
+// .alias add/remove/list, in the channel or a private message
+func (cl *channelLogger) aliasCommand(c *commandContext) {
+	nick := normalizeNick(c.line.Nick)
+	if len(c.args) == 1 && c.args[0] == "list" {
+		aliases, err := cl.site.aliasesFor(nick)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if len(aliases) == 0 {
+			c.reply("you don't have any aliases")
+			return
+		}
+		c.reply("your aliases: " + strings.Join(aliases, ", "))
+		return
+	}
+	if len(c.args) != 2 || (c.args[0] != "add" && c.args[0] != "remove") {
+		c.replySyntax()
+		return
+	}
+	alias := c.args[1]
+	if len(nickTokens(alias)) != 1 || nickTokens(alias)[0] != alias {
+		c.reply(fmt.Sprintf("%s can't be an alias", alias))
+		return
+	}
+	if c.args[0] == "add" {
+		err := cl.site.addAlias(nick, alias)
+		if err != nil {
+			c.reply(fmt.Sprintf("couldn't add %s: %s", alias, err))
+			return
+		}
+		c.reply(fmt.Sprintf("ok, mentions of %s will reach you", alias))
+		return
+	}
+	err := cl.site.removeAlias(nick, alias)
+	if err != nil {
+		c.reply(fmt.Sprintf("couldn't remove %s: %s", alias, err))
+		return
+	}
+	c.reply(fmt.Sprintf("ok, removed %s", alias))
+}
+
+func (s *site) addAlias(nick, alias string) error {
+	alias = strings.ToLower(normalizeNick(alias))
+	if strings.EqualFold(alias, nick) {
+		return errors.New("that's already your nick")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// don't let anyone take over someone else's nick
+		nicks := tx.Bucket([]byte("nicks"))
+		found := false
+		nicks.ForEach(func(k, v []byte) error {
+			found = found || strings.EqualFold(string(k), alias)
+			return nil
+		})
+		if found {
+			return errAliasTaken
+		}
+		b := tx.Bucket([]byte("aliases"))
+		if v := b.Get([]byte(alias)); v != nil && string(v) != nick {
+			return errAliasTaken
+		}
+		return b.Put([]byte(alias), []byte(nick))
+	})
+}
+
+func (s *site) removeAlias(nick, alias string) error {
+	alias = strings.ToLower(normalizeNick(alias))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("aliases"))
+		if v := b.Get([]byte(alias)); v == nil || string(v) != nick {
+			return errors.New("that isn't one of your aliases")
+		}
+		return b.Delete([]byte(alias))
+	})
+}
+
+// nick -> aliases, for everyone
+func (s site) allAliases() (map[string][]string, error) {
+	aliases := map[string][]string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("aliases"))
+		return b.ForEach(func(k, v []byte) error {
+			aliases[string(v)] = append(aliases[string(v)], string(k))
+			return nil
+		})
+	})
+	return aliases, err
+}
+
+func (s site) aliasesFor(nick string) ([]string, error) {
+	aliases, err := s.allAliases()
+	return aliases[nick], err
+}
+
+// the nick that goes by this name, which is usually just the name
+func (s site) resolveAlias(name string) (string, error) {
+	nick := name
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("aliases"))
+		if v := b.Get([]byte(strings.ToLower(name))); v != nil {
+			nick = string(v)
+		}
+		return nil
+	})
+	return nick, err
+}
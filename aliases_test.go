@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_aliases(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	now := time.Now()
+	s.userLogger.update(nil, now, func(c string, nicks []string) []string {
+		return []string{"thraxil", "bob"}
+	})
+
+	if err := s.addAlias("thraxil", "Anders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addAlias("bob", "anders"); err != errAliasTaken {
+		t.Error("bob shouldn't be able to take anders", err)
+	}
+	if err := s.addAlias("bob", "thraxil"); err != errAliasTaken {
+		t.Error("bob shouldn't be able to take thraxil's nick", err)
+	}
+	if a, _ := s.aliasesFor("thraxil"); len(a) != 1 || a[0] != "anders" {
+		t.Error(a)
+	}
+	if n, _ := s.resolveAlias("ANDERS"); n != "thraxil" {
+		t.Error(n)
+	}
+	if n, _ := s.resolveAlias("carol"); n != "carol" {
+		t.Error(n)
+	}
+
+	// thraxil leaves, and someone mentions anders
+	s.userLogger.update(nil, now, func(c string, nicks []string) []string {
+		return []string{"bob"}
+	})
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	s.channelLogger.saveMentions(conn, "#one", testLine("bob", "#one", "has anders seen this?", now))
+	expectLine(t, lines, "PRIVMSG bob :thraxil is not in the channel")
+	if m, _ := s.messagesFor("thraxil"); len(m) != 1 {
+		t.Error(m)
+	}
+
+	if err := s.removeAlias("bob", "anders"); err == nil {
+		t.Error("bob can't remove thraxil's alias")
+	}
+	if err := s.removeAlias("thraxil", "anders"); err != nil {
+		t.Error(err)
+	}
+	if a, _ := s.aliasesFor("thraxil"); len(a) != 0 {
+		t.Error(a)
+	}
+}
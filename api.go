@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// a JSON version of the logs, links and search for scripts and
+// dashboards. everything in here comes from the same site methods the
+// HTML views use.
+
+const (
+	apiDefaultLimit = 50
+	maxLimit        = 500
+)
+
+type apiLine struct {
+	Channel   string    `json:"channel"`
+	Nick      string    `json:"nick"`
+	Text      string    `json:"text"`
+	Kind      string    `json:"kind"`
+	Timestamp time.Time `json:"timestamp"`
+	Permalink string    `json:"permalink"`
+}
+
+func newAPILines(s *site, lines []lineEntry) []apiLine {
+	out := []apiLine{}
+	for _, l := range lines {
+		kind := l.Kind
+		if kind == "" {
+			kind = kindMessage
+		}
+		out = append(out, apiLine{
+			Channel:   l.Channel,
+			Nick:      l.Nick,
+			Text:      l.Text,
+			Kind:      kind,
+			Timestamp: l.Timestamp,
+			Permalink: s.BaseURL + l.Permalink(),
+		})
+	}
+	return out
+}
+
+type apiLink struct {
+	Key        string    `json:"key"`
+	Channel    string    `json:"channel"`
+	Nick       string    `json:"nick"`
+	URL        string    `json:"url"`
+	Title      string    `json:"title"`
+	Timestamp  time.Time `json:"timestamp"`
+	Discussion string    `json:"discussion"`
+	// picked up from the channel rather than saved with .url
+	Auto        bool   `json:"auto"`
+	Description string `json:"description,omitempty"`
+}
+
+func newAPILinks(s *site, links []linkEntry) []apiLink {
+	out := []apiLink{}
+	for _, l := range links {
+		out = append(out, apiLink{
+			Key:         l.Key,
+			Channel:     l.Channel,
+			Nick:        l.Nick,
+			URL:         l.URL,
+			Title:       l.Title,
+			Timestamp:   l.Timestamp,
+			Discussion:  s.BaseURL + l.DiscussionLink(),
+			Auto:        l.Auto,
+			Description: l.Description,
+		})
+	}
+	return out
+}
+
+type apiMention struct {
+	From      string    `json:"from"`
+	Channel   string    `json:"channel"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+	State     string    `json:"state"`
+	Tell      bool      `json:"tell"`
+	Permalink string    `json:"permalink,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// a limit/size parameter, with a default and a ceiling
+func formLimit(r *http.Request, name string, def int) (int, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	if n > maxLimit {
+		n = maxLimit
+	}
+	return n, true
+}
+
+// ?channel=<slug>, or the default channel if it's not given
+func apiChannel(w http.ResponseWriter, r *http.Request, s *site) (string, bool) {
+	slug := r.FormValue("channel")
+	if slug == "" {
+		return s.defaultChannel(), true
+	}
+	channel, ok := s.channelForSlug(slug)
+	if !ok {
+		apiError(w, 404, "no such channel")
+	}
+	return channel, ok
+}
+
+// /api/v1/logs/<channel>/<year>/<month>/<day>, or without the channel
+// for the default one, like /logs/
+func apiLogsHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/logs/"), "/"), "/")
+	channel := s.defaultChannel()
+	if len(parts) == 4 {
+		c, ok := s.channelForSlug(parts[0])
+		if !ok {
+			apiError(w, 404, "no such channel")
+			return
+		}
+		channel = c
+		parts = parts[1:]
+	}
+	if len(parts) != 3 || !isYear(parts[0]) {
+		apiError(w, 400, "expected /api/v1/logs/[channel/]year/month/day")
+		return
+	}
+	lines, err := s.linesForDay(channel, parts[0], parts[1], parts[2])
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, 200, struct {
+		Channel string    `json:"channel"`
+		Date    string    `json:"date"`
+		Lines   []apiLine `json:"lines"`
+	}{channel, strings.Join(parts, "-"), newAPILines(s, lines)})
+}
+
+func apiYearsHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	channel, ok := apiChannel(w, r, s)
+	if !ok {
+		return
+	}
+	years, err := s.years(channel)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, 200, struct {
+		Channel string   `json:"channel"`
+		Years   []string `json:"years"`
+	}{channel, years})
+}
+
+func apiNicksHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	nicks, err := s.allKnownNicks()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, 200, struct {
+		Nicks []string `json:"nicks"`
+	}{nicks})
+}
+
+// newest first, filtered like /links/. pass the "next" we hand back
+// as ?before= to get the page after this one
+func apiLinksHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	f, err := parseLinkFilter(r)
+	if err != nil {
+		apiError(w, 400, err.Error())
+		return
+	}
+	limit, ok := formLimit(r, "limit", apiDefaultLimit)
+	if !ok {
+		apiError(w, 400, "bad limit")
+		return
+	}
+	links, next, err := s.links(f, r.FormValue("before"), limit)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, 200, struct {
+		Links []apiLink `json:"links"`
+		Next  string    `json:"next,omitempty"`
+	}{newAPILinks(s, links), next})
+}
+
+// /api/v1/mentions/<nick>: what we're holding for someone
+func apiMentionsHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	nick := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/mentions/"), "/")
+	if nick == "" || strings.Contains(nick, "/") {
+		apiError(w, 400, "expected /api/v1/mentions/nick")
+		return
+	}
+	messages, err := s.messagesFor(nick)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	out := []apiMention{}
+	for _, m := range messages {
+		if m.Channel == "" {
+			// a .tell in a private message. that's between them
+			continue
+		}
+		am := apiMention{
+			From:      m.Nick,
+			Channel:   m.Channel,
+			Text:      m.Text,
+			Timestamp: m.Timestamp,
+			State:     m.State,
+			Tell:      m.Tell,
+		}
+		if m.Key != "" {
+			am.Permalink = s.BaseURL + m.Permalink()
+		}
+		out = append(out, am)
+	}
+	writeJSON(w, 200, struct {
+		Nick     string       `json:"nick"`
+		Mentions []apiMention `json:"mentions"`
+	}{normalizeNick(nick), out})
+}
+
+// ?q= with the same query syntax as /search/, and ?type=links to
+// search links instead of the logs. ?from= is an offset, and "next"
+// is the one to use for the following page
+func apiSearchHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	q := r.FormValue("q")
+	if q == "" {
+		apiError(w, 400, "q is required")
+		return
+	}
+	size, ok := formLimit(r, "size", apiDefaultLimit)
+	if !ok {
+		apiError(w, 400, "bad size")
+		return
+	}
+	from := 0
+	if v := r.FormValue("from"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			apiError(w, 400, "bad from")
+			return
+		}
+		from = n
+	}
+
+	resp := struct {
+		Query string    `json:"query"`
+		Total uint64    `json:"total"`
+		Lines []apiLine `json:"lines,omitempty"`
+		Links []apiLink `json:"links,omitempty"`
+		Next  *int      `json:"next,omitempty"`
+	}{Query: q}
+	var result *bleve.SearchResult
+	var err error
+	if r.FormValue("type") == "links" {
+		var links []linkEntry
+		result, links, err = s.searchLinks(q, size, from)
+		resp.Links = newAPILinks(s, links)
+	} else {
+		var lines []lineEntry
+		result, lines, err = s.searchLines(q, size, from)
+		resp.Lines = newAPILines(s, lines)
+	}
+	if err != nil && result == nil {
+		// the search itself failed, which is usually a bad query
+		apiError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	resp.Total = result.Total
+	if uint64(from+len(result.Hits)) < result.Total {
+		next := from + len(result.Hits)
+		resp.Next = &next
+	}
+	writeJSON(w, 200, resp)
+}
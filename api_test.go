@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func apiGet(t *testing.T, s *site, h func(w http.ResponseWriter, r *http.Request, s *site), url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", url, nil), s)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(url, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func Test_apiLogs(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one", "#two")
+	defer cleanup()
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	s.channelLogger.logLine("#one", testLine("alice", "#one", "hello one", ts))
+	s.channelLogger.logLine("#two", testLine("bob", "#two", "hello two", ts))
+
+	var day struct {
+		Channel string
+		Date    string
+		Lines   []apiLine
+	}
+	if code := apiGet(t, s, apiLogsHandler, "/api/v1/logs/2015/02/15/", &day); code != 200 {
+		t.Fatal(code)
+	}
+	if day.Channel != "#one" || len(day.Lines) != 1 || day.Lines[0].Text != "hello one" ||
+		day.Lines[0].Kind != kindMessage {
+		t.Error(day)
+	}
+	if day.Lines[0].Permalink != "http://example.com/logs/one/2015/02/15/#2015-02-15T12:04:36.439011141-05:00" {
+		t.Error(day.Lines[0].Permalink)
+	}
+	apiGet(t, s, apiLogsHandler, "/api/v1/logs/two/2015/02/15", &day)
+	if day.Channel != "#two" || len(day.Lines) != 1 || day.Lines[0].Nick != "bob" {
+		t.Error(day)
+	}
+	if code := apiGet(t, s, apiLogsHandler, "/api/v1/logs/three/2015/02/15", nil); code != 404 {
+		t.Error(code)
+	}
+	if code := apiGet(t, s, apiLogsHandler, "/api/v1/logs/2015/02/", nil); code != 400 {
+		t.Error(code)
+	}
+
+	var years struct{ Years []string }
+	apiGet(t, s, apiYearsHandler, "/api/v1/years?channel=two", &years)
+	if len(years.Years) != 1 || years.Years[0] != "2015" {
+		t.Error(years)
+	}
+
+	var found struct {
+		Total uint64
+		Lines []apiLine
+		Next  *int
+	}
+	apiGet(t, s, apiSearchHandler, "/api/v1/search?q=hello&size=1", &found)
+	if found.Total != 2 || len(found.Lines) != 1 || found.Next == nil || *found.Next != 1 {
+		t.Fatal(found)
+	}
+	first := found.Lines[0].Text
+	found.Next = nil
+	apiGet(t, s, apiSearchHandler, "/api/v1/search?q=hello&size=1&from=1", &found)
+	if len(found.Lines) != 1 || found.Lines[0].Text == first || found.Next != nil {
+		t.Error(found)
+	}
+	if code := apiGet(t, s, apiSearchHandler, "/api/v1/search?q=hello&size=lots", nil); code != 400 {
+		t.Error(code)
+	}
+}
+
+func Test_apiLinks(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	for i := 0; i < 5; i++ {
+		s.saveLink("#one", testLine("alice", "#one", "", ts.Add(time.Duration(i)*time.Minute)),
+			fmt.Sprintf("http://example.com/%d", i), fmt.Sprintf("link %d", i))
+	}
+
+	var page struct {
+		Links []apiLink
+		Next  string
+	}
+	seen := []string{}
+	url := "/api/v1/links?limit=2"
+	for {
+		page.Next = ""
+		apiGet(t, s, apiLinksHandler, url, &page)
+		for _, l := range page.Links {
+			seen = append(seen, l.Title)
+		}
+		if page.Next == "" {
+			break
+		}
+		url = "/api/v1/links?limit=2&before=" + page.Next
+	}
+	if fmt.Sprint(seen) != "[link 4 link 3 link 2 link 1 link 0]" {
+		t.Error(seen)
+	}
+	if code := apiGet(t, s, apiLinksHandler, "/api/v1/links?limit=0", nil); code != 400 {
+		t.Error(code)
+	}
+}
+
+func Test_apiMentions(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, _, closeConn := newTestConn(t)
+	defer closeConn()
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	s.channelLogger.saveMention("alice", "#one", testLine("bob", "#one", "alice: ping", ts), conn)
+	s.channelLogger.dispatch(conn, "", testLine("carol", "frontdesk", ".tell alice a secret", ts))
+	s.channelLogger.wait()
+	if m, _ := s.messagesFor("alice"); len(m) != 2 {
+		t.Fatal(m)
+	}
+
+	var held struct {
+		Nick     string
+		Mentions []apiMention
+	}
+	apiGet(t, s, apiMentionsHandler, "/api/v1/mentions/alice_", &held)
+	if held.Nick != "alice" || len(held.Mentions) != 1 || held.Mentions[0].From != "bob" ||
+		held.Mentions[0].State != mentionPending {
+		t.Error(held)
+	}
+}
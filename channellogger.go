@@ -5,71 +5,181 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/boltdb/bolt"
 	irc "github.com/fluffle/goirc/client"
 )
 
 type channelLogger struct {
-	db      *bolt.DB
-	channel string
-	site    *site
+	db       *bolt.DB
+	site     *site
+	commands *commandSet
+
+	// commands and mentions are handled in the background
+	wg sync.WaitGroup
+}
+
+func newChannelLogger(db *bolt.DB, site *site) *channelLogger {
+	cl := &channelLogger{db: db, site: site, commands: newCommandSet()}
+	cl.registerCommands()
+	return cl
 }
 
-func newChannelLogger(db *bolt.DB, channel string, site *site) *channelLogger {
-	return &channelLogger{db, channel, site}
+func (cl *channelLogger) background(f func()) {
+	cl.wg.Add(1)
+	go func() {
+		defer cl.wg.Done()
+		f()
+	}()
+}
+
+// wait for anything running in the background to finish
+func (cl *channelLogger) wait() {
+	cl.wg.Wait()
 }
 
 func (cl *channelLogger) Handle(conn *irc.Conn, line *irc.Line) {
+	switch line.Cmd {
+	case "PRIVMSG", "ACTION":
+		cl.handleMessage(conn, line)
+	case "JOIN", "PART", "TOPIC", "MODE":
+		if channel, ok := cl.site.configuredChannel(line.Target()); ok {
+			err := cl.logEvent(channel, strings.ToLower(line.Cmd), line.Nick,
+				strings.Join(line.Args[1:], " "), line.Time)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	case "KICK":
+		// args are: channel, kicked nick, reason
+		if len(line.Args) < 2 {
+			return
+		}
+		if channel, ok := cl.site.configuredChannel(line.Args[0]); ok {
+			err := cl.logEvent(channel, kindKick, line.Nick,
+				withReason(line.Args[1], strings.Join(line.Args[2:], " ")), line.Time)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	// QUIT and NICK don't say which channel they're in, so userLogger
+	// works that out and logs them
+}
+
+func (cl *channelLogger) handleMessage(conn *irc.Conn, line *irc.Line) {
 	if strings.HasPrefix(line.Text(), "otr:") {
 		// this is off the record
 		return
 	}
-	if line.Target() == cl.channel {
-		cl.logLine(line)
-		go cl.saveUrls(conn, line)
-		go cl.saveMentions(conn, line)
-	} else {
-		// process it for commands
-	}
-}
-
-func (cl *channelLogger) saveUrls(conn *irc.Conn, line *irc.Line) {
-	if !strings.HasPrefix(line.Text(), ".url") {
+	// if it isn't one of our channels, it's a private message, and
+	// channel is empty
+	channel, ok := cl.site.configuredChannel(line.Target())
+	if cl.dispatch(conn, channel, line) {
 		return
 	}
-	parts := strings.Split(line.Text(), " ")
-	if len(parts) == 1 {
-		conn.Privmsg(line.Nick, "syntax: .url http://example.com/ title for link")
+	if !ok {
 		return
 	}
-	url := parts[1]
+	if err := cl.logLine(channel, line); err != nil {
+		log.Println(err)
+	}
+	// if they're talking, they got whatever we sent them. and
+	// they're not away, so they can have anything new
+	if _, err := cl.site.acknowledgeMessages(line.Nick); err != nil {
+		log.Println("couldn't acknowledge messages for", line.Nick, err)
+	}
+	pending, err := cl.site.hasPendingMessages(line.Nick)
+	if err != nil {
+		log.Println("couldn't check messages for", line.Nick, err)
+	}
+	if pending {
+		if err := cl.site.deliverMessages(line.Nick, conn); err != nil {
+			log.Println("couldn't deliver messages to", line.Nick, err)
+		}
+	}
+	cl.background(func() { cl.saveMentions(conn, channel, line) })
+	// a command's URLs are the command's business (.url saves its own,
+	// .tell and .tweet aren't sharing them with the channel)
+	if cl.site.fetcher != nil && !cl.isCommand(line) {
+		// only the first one, since links are keyed on when the
+		// line was said
+		if u := findURL(line.Text()); u != "" {
+			cl.background(func() { cl.captureLink(conn, channel, line, u) })
+		}
+	}
+}
+
+func (cl *channelLogger) urlCommand(c *commandContext) {
+	url, title := c.args[0], c.args[1]
 	if !strings.HasPrefix(url, "http") {
 		// doesn't look like a URL
-		conn.Privmsg(line.Nick, fmt.Sprintf("%s doesn't look like a URL", url))
+		c.reply(fmt.Sprintf("%s doesn't look like a URL", url))
 		return
 	}
-	if len(parts) == 2 {
-		conn.Privmsg(line.Nick, "syntax: .url http://example.com/ title for link")
+	le := newLinkEntry(c.channel, c.line, url, title)
+	if err := cl.site.storeLink(le); err != nil {
+		c.fail(err)
 		return
 	}
-	title := strings.Join(parts[2:], " ")
-	cl.site.saveLink(line, url, title)
-	cl.site.tweetLink(line.Nick, url, title)
-	conn.Privmsg(line.Nick, "saved your link")
+	c.reply("saved your link")
+	if err := cl.site.publishLink(le); err != nil {
+		log.Println("couldn't record where", url, "was published", err)
+	}
+}
+
+// IRC nicks are letters, digits and a handful of special characters
+func isNickChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("[]\\`_^{|}-", r)
+}
+
+// the words in a line that could be nicks. anything else (spaces,
+// punctuation, the @ in "@alice") separates them
+func nickTokens(line string) []string {
+	return strings.FieldsFunc(line, func(r rune) bool {
+		return !isNickChar(r)
+	})
 }
 
 func mentionsNick(line, nick string) bool {
-	return strings.Contains(line, nick+": ") || strings.Contains(line, nick+" ") || strings.Contains(line, nick+"_")
+	return mentionsAny(line, []string{nick})
 }
 
-func (cl *channelLogger) saveMentions(conn *irc.Conn, line *irc.Line) {
-	nicksToCheck := cl.site.offlineNicks()
+func mentionsAny(line string, nicks []string) bool {
+	for _, t := range nickTokens(line) {
+		for _, n := range nicks {
+			if strings.EqualFold(normalizeNick(t), n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cl *channelLogger) saveMentions(conn *irc.Conn, channel string, line *irc.Line) {
+	if strings.HasPrefix(line.Text(), ".tell") {
+		// they're already leaving a message explicitly
+		return
+	}
+	nicksToCheck, err := cl.site.offlineNicks()
+	if err != nil {
+		log.Println("couldn't check for mentions:", err)
+		return
+	}
+	aliases, err := cl.site.allAliases()
+	if err != nil {
+		log.Println("couldn't check for mentions:", err)
+		return
+	}
 	for _, n := range nicksToCheck {
-		if mentionsNick(line.Text(), n) {
+		if mentionsAny(line.Text(), append([]string{n}, aliases[n]...)) {
 			// offline user was mentioned
-			cl.saveMention(n, line, conn)
+			if err := cl.saveMention(n, channel, line, conn); err != nil {
+				log.Println("couldn't save a mention of", n, err)
+			}
 		}
 	}
 }
@@ -82,26 +192,74 @@ type mention struct {
 	Key       string    `json:"key"`
 	Text      string    `json:"text"`
 	Timestamp time.Time `json:"timestamp"`
+	Channel   string    `json:"channel"`
+
+	// we hang on to messages after sending them until the recipient
+	// acknowledges them, in case they never actually got them
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+
+	// left explicitly with .tell rather than just mentioning someone
+	Tell bool `json:"tell"`
 }
 
+const (
+	mentionPending   = "pending"
+	mentionDelivered = "delivered"
+)
+
 func (m mention) Permalink() string {
-	return fmt.Sprintf("/logs/%04d/%02d/%02d/#%s", m.Year, m.Month, m.Day, m.Key)
+	return dayURL(m.Channel, m.Year, m.Month, m.Day) + "#" + m.Key
 }
 
 type mentions struct {
 	Mentions []mention `json:"mentions"`
 }
 
-func (cl *channelLogger) saveMention(nick string, line *irc.Line, conn *irc.Conn) {
+func newMention(channel string, line *irc.Line) mention {
 	year, month, day := line.Time.Date()
 	key := line.Time.Format(time.RFC3339Nano)
-	m := mention{normalizeNick(line.Nick), year,
-		int(month), day, key, line.Text(), line.Time}
+	return mention{
+		Nick:      normalizeNick(line.Nick),
+		Year:      year,
+		Month:     int(month),
+		Day:       day,
+		Key:       key,
+		Text:      line.Text(),
+		Timestamp: line.Time,
+		Channel:   channel,
+		State:     mentionPending,
+	}
+}
 
+func (cl *channelLogger) saveMention(nick, channel string, line *irc.Line, conn *irc.Conn) error {
+	m := newMention(channel, line)
+	if err := cl.storeMention(nick, m); err != nil {
+		return err
+	}
+	address, err := cl.site.emailFor(nick)
+	if err != nil {
+		log.Println("couldn't look up an email address for", nick, err)
+	}
+	if address != "" && cl.site.mailer != nil {
+		cl.site.mailer.queue(address, m)
+	}
+	cl.site.outbox.privmsg(conn, line.Nick, fmt.Sprintf("%s is not in the channel right now, but I'll deliver your message when they return", nick))
+	return nil
+}
+
+// mentions are kept under the lowercased nick, since IRC doesn't care
+// how it's capitalized
+func mentionKey(nick string) []byte {
+	return []byte(strings.ToLower(normalizeNick(nick)))
+}
+
+func (cl *channelLogger) storeMention(nick string, m mention) error {
 	var ms mentions
 	err := cl.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("mentions"))
-		v := bucket.Get([]byte(nick))
+		v := bucket.Get(mentionKey(nick))
 		if v == nil {
 			// create
 			ms.Mentions = []mention{m}
@@ -118,27 +276,67 @@ func (cl *channelLogger) saveMention(nick string, line *irc.Line, conn *irc.Conn
 		if err != nil {
 			return err
 		}
-		return bucket.Put([]byte(nick), data)
+		return bucket.Put(mentionKey(nick), data)
 	})
-	if err != nil {
-		log.Fatal(err)
+	if err == nil {
+		mentionsStored.Inc()
 	}
-	conn.Privmsg(line.Nick, fmt.Sprintf("%s is not in the channel right now, but I'll deliver your message when they return", nick))
+	return err
 }
 
-func (cl *channelLogger) logLine(line *irc.Line) {
-	year, month, day := line.Time.Date()
-	le := lineEntry{normalizeNick(line.Nick), line.Text(), line.Time}
+func (cl *channelLogger) logLine(channel string, line *irc.Line) error {
+	kind := kindMessage
+	if line.Cmd == "ACTION" {
+		kind = kindAction
+	}
+	return cl.storeLine(lineEntry{
+		Nick:      normalizeNick(line.Nick),
+		Text:      line.Text(),
+		Timestamp: line.Time,
+		Channel:   channel,
+		Kind:      kind,
+	})
+}
+
+// joins, parts, etc. text is whatever goes after the nick
+func (cl *channelLogger) logEvent(channel, kind, nick, text string, ts time.Time) error {
+	return cl.storeLine(lineEntry{
+		Nick:      normalizeNick(nick),
+		Text:      text,
+		Timestamp: ts,
+		Channel:   channel,
+		Kind:      kind,
+	})
+}
+
+// if a line can't be written to the db or the index, it goes in the
+// spool to try again later. this only returns an error if we couldn't
+// hang on to it at all
+func (cl *channelLogger) storeLine(le lineEntry) error {
+	err := cl.persistLine(le)
+	if err == nil {
+		return nil
+	}
+	if serr := cl.site.spool.add(le, err); serr != nil {
+		return fmt.Errorf("lost a line for %s: couldn't store it (%s) or spool it (%s)", le.Channel, err, serr)
+	}
+	return nil
+}
+
+func (cl *channelLogger) persistLine(le lineEntry) error {
+	year, month, day := le.Timestamp.Date()
 	data, err := json.Marshal(le)
 	if err != nil {
-		log.Println("error marshalling to json")
-		log.Println(err)
-		return
+		return err
 	}
 
 	err = cl.db.Update(func(tx *bolt.Tx) error {
 		lines := tx.Bucket([]byte("lines"))
-		ybucket, err := lines.CreateBucketIfNotExists([]byte(fmt.Sprintf("%04d", year)))
+		cbucket, err := lines.CreateBucketIfNotExists([]byte(le.Channel))
+		if err != nil {
+			return err
+		}
+		ybucket, err := cbucket.CreateBucketIfNotExists([]byte(fmt.Sprintf("%04d", year)))
 		if err != nil {
 			return err
 		}
@@ -154,7 +352,27 @@ func (cl *channelLogger) logLine(line *irc.Line) {
 		return err
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if le.Searchable() {
+		if err := cl.site.indexLine(le); err != nil {
+			return err
+		}
+	}
+	linesLogged.WithLabelValues(le.Channel).Inc()
+	return nil
+}
+
+// keep trying to get anything in the spool into the db
+func (cl *channelLogger) runSpool() {
+	for {
+		if err := cl.site.spool.replay(cl.persistLine); err != nil {
+			log.Println("couldn't replay the spool:", err)
+		}
+		select {
+		case <-cl.site.stopping:
+			return
+		case <-time.After(spoolInterval):
+		}
 	}
-	cl.site.indexLine(line)
 }
@@ -3,16 +3,23 @@ package main
 import (
 	"testing"
 	"time"
+
+	irc "github.com/fluffle/goirc/client"
 )
 
 func Test_mentionPermalink(t *testing.T) {
 	m := mention{
-		"foo",
-		2015, 02, 17, "a-key", "some text", time.Now(),
+		Nick: "foo",
+		Year: 2015, Month: 02, Day: 17, Key: "a-key", Text: "some text",
+		Timestamp: time.Now(),
 	}
 	if m.Permalink() != "/logs/2015/02/17/#a-key" {
 		t.Error("bad permalink")
 	}
+	m.Channel = "#frontdesk"
+	if m.Permalink() != "/logs/frontdesk/2015/02/17/#a-key" {
+		t.Error("bad permalink", m.Permalink())
+	}
 }
 
 type mentionTestCase struct {
@@ -53,17 +60,36 @@ func Test_mentionsNick(t *testing.T) {
 			Nick:        "alice",
 			ExpectMatch: false,
 		},
-		// currently failing cases
-		//		{
-		//			Line:        "malice is not intendend",
-		//			Nick:        "alice",
-		//			ExpectMatch: false,
-		//		},
-		//		{
-		//			Line:        "but now i'm going to mention alice",
-		//			Nick:        "alice",
-		//			ExpectMatch: true,
-		//		},
+		{
+			Line:        "malice is not intendend",
+			Nick:        "alice",
+			ExpectMatch: false,
+		},
+		{
+			Line:        "but now i'm going to mention alice",
+			Nick:        "alice",
+			ExpectMatch: true,
+		},
+		{
+			Line:        "have you asked @alice?",
+			Nick:        "alice",
+			ExpectMatch: true,
+		},
+		{
+			Line:        "that's alice's problem",
+			Nick:        "alice",
+			ExpectMatch: true,
+		},
+		{
+			Line:        "ask Alice, she knows",
+			Nick:        "alice",
+			ExpectMatch: true,
+		},
+		{
+			Line:        "alicebob is someone else",
+			Nick:        "alice",
+			ExpectMatch: false,
+		},
 	}
 	for _, tc := range cases {
 		r := mentionsNick(tc.Line, tc.Nick)
@@ -72,3 +98,107 @@ func Test_mentionsNick(t *testing.T) {
 		}
 	}
 }
+
+func Test_logEvents(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one", "#two")
+	defer cleanup()
+	cl := s.channelLogger
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	next := func() time.Time {
+		ts = ts.Add(time.Second)
+		return ts
+	}
+
+	cl.Handle(nil, &irc.Line{Cmd: "JOIN", Nick: "alice", Args: []string{"#one"}, Time: next()})
+	s.userLogger.Handle(nil, &irc.Line{Cmd: "JOIN", Nick: "alice", Args: []string{"#one"}, Time: ts})
+	cl.Handle(nil, &irc.Line{Cmd: "ACTION", Nick: "alice", Args: []string{"#one", "waves"}, Time: next()})
+	cl.Handle(nil, &irc.Line{Cmd: "TOPIC", Nick: "alice", Args: []string{"#one", "new topic"}, Time: next()})
+	cl.Handle(nil, &irc.Line{Cmd: "MODE", Nick: "alice", Args: []string{"#one", "+o", "bob"}, Time: next()})
+	cl.Handle(nil, &irc.Line{Cmd: "KICK", Nick: "alice", Args: []string{"#one", "bob", "behave"}, Time: next()})
+	s.userLogger.Handle(nil, &irc.Line{Cmd: "NICK", Nick: "alice", Args: []string{"alice2"}, Time: next()})
+	s.userLogger.Handle(nil, &irc.Line{Cmd: "QUIT", Nick: "alice2", Args: []string{"bye"}, Time: next()})
+	cl.Handle(nil, &irc.Line{Cmd: "PART", Nick: "carol", Args: []string{"#elsewhere", "bye"}, Time: next()})
+
+	expected := []string{
+		"alice has joined",
+		"* alice waves",
+		"alice changed the topic to: new topic",
+		"alice sets mode +o bob",
+		"alice kicked bob (behave)",
+		"alice is now known as alice2",
+		"alice2 has quit (bye)",
+	}
+	lines, _ := s.linesForDay("#one", "2015", "02", "15")
+	if len(lines) != len(expected) {
+		t.Fatal(lines)
+	}
+	for i, l := range lines {
+		if l.EventText() != expected[i] {
+			t.Errorf("%q != %q", l.EventText(), expected[i])
+		}
+	}
+	if !lines[0].IsMembership() || lines[1].IsMembership() {
+		t.Error("joins are noise, actions aren't")
+	}
+	if other, _ := s.linesForDay("#two", "2015", "02", "15"); len(other) != 0 {
+		t.Error("alice wasn't in #two")
+	}
+
+	// only things people said are searchable
+	if n, _ := s.index.DocCount(); n != 2 {
+		t.Error("expected the action and topic to be indexed", n)
+	}
+}
+
+func Test_deliverAndAcknowledge(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	cl := s.channelLogger
+
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	cl.saveMention("alice", "#one", testLine("bob", "#one", "alice: ping", ts), conn)
+	expectLine(t, lines, "PRIVMSG bob :alice is not in the channel")
+	if m, _ := s.messagesFor("alice"); len(m) != 1 || m[0].State != mentionPending {
+		t.Fatal(m)
+	}
+
+	// she shows up, gets the message, and leaves without seeing it
+	s.deliverMessages("alice", conn)
+	expectLine(t, lines, "PRIVMSG alice :messages while you were out: 1")
+	if l := expectLine(t, lines, "PRIVMSG alice :from"); l != "PRIVMSG alice :from bob: alice: ping" {
+		t.Error(l)
+	}
+	if m, _ := s.messagesFor("alice"); len(m) != 1 || m[0].State != mentionDelivered || m[0].Attempts != 1 {
+		t.Fatal("should still have it", m)
+	}
+
+	// another one comes in while she's gone
+	cl.saveMention("alice", "#one", testLine("bob", "#one", "alice: ping again", ts.Add(time.Minute)), conn)
+
+	// next time, she gets both
+	s.deliverMessages("alice_", conn)
+	expectLine(t, lines, "PRIVMSG alice_ :messages while you were out: 2")
+	m, _ := s.messagesFor("alice")
+	if len(m) != 2 || m[0].Attempts != 2 || m[1].Attempts != 1 {
+		t.Fatal(m)
+	}
+
+	// something new after delivery should stick around when she acks
+	cl.saveMention("alice", "#one", testLine("bob", "#one", "alice: one more", ts.Add(2*time.Minute)), conn)
+
+	// talking in the channel counts as acknowledging them, and she's
+	// clearly around to get the new one
+	cl.Handle(conn, testLine("alice_", "#one", "thanks", ts.Add(3*time.Minute)))
+	m, _ = s.messagesFor("alice")
+	if len(m) != 1 || m[0].Text != "alice: one more" || m[0].State != mentionDelivered {
+		t.Error(m)
+	}
+
+	cl.Handle(conn, testLine("alice", "frontdesk", ".ack", ts.Add(4*time.Minute)))
+	expectLine(t, lines, "PRIVMSG alice :ok, cleared 1 messages")
+	if m, _ := s.messagesFor("alice"); len(m) != 0 {
+		t.Error(m)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// dot-commands. they're all registered with the channelLogger, which
+// looks at the first word of every message and, if it's a command,
+// checks where it was said, who said it and what arguments it got
+// before running it in the background.
+
+type permission int
+
+const (
+	anyone permission = iota
+	// admins have to be identified with NickServ too
+	adminsOnly
+	// the .tweet list, also identified
+	tweetersOnly
+	// anyone, as long as they're identified with NickServ as the nick
+	// they're using
+	identified
+)
+
+// where a command can be used
+type scope int
+
+const (
+	inChannel scope = 1 << iota
+	inPrivate
+	anywhere = inChannel | inPrivate
+)
+
+// splits up whatever follows the command name. returns false if
+// it doesn't fit
+type argParser func(text string) ([]string, bool)
+
+// between min and max words
+func words(min, max int) argParser {
+	return func(text string) ([]string, bool) {
+		args := strings.Fields(text)
+		return args, len(args) >= min && len(args) <= max
+	}
+}
+
+// n words, and then everything else (which there has to be some of)
+// as one more argument
+func wordsThenRest(n int) argParser {
+	return func(text string) ([]string, bool) {
+		args := strings.Fields(text)
+		if len(args) <= n {
+			return nil, false
+		}
+		return append(args[:n:n], strings.Join(args[n:], " ")), true
+	}
+}
+
+type command struct {
+	name    string
+	aliases []string
+	// what goes after the name, eg "nick message". one for each
+	// form the command takes
+	usage []string
+	help  string
+	args  argParser
+	perm  permission
+	scope scope
+	// run right away rather than in the background, and don't do
+	// anything else with the line (like logging it)
+	inline bool
+	run    func(c *commandContext)
+}
+
+// eg, ".alias add name, .alias remove name, or .alias list"
+func (cmd *command) syntax() string {
+	forms := []string{}
+	for _, u := range cmd.usage {
+		forms = append(forms, strings.TrimSpace("."+cmd.name+" "+u))
+	}
+	switch len(forms) {
+	case 0:
+		return "." + cmd.name
+	case 1:
+		return forms[0]
+	}
+	return strings.Join(forms[:len(forms)-1], ", ") + ", or " + forms[len(forms)-1]
+}
+
+// everything a command gets when it runs
+type commandContext struct {
+	command *command
+	outbox  *outbox
+	conn    *irc.Conn
+	line    *irc.Line
+	// empty in a private message
+	channel string
+	args    []string
+}
+
+// replies go to whoever used the command, privately
+func (c *commandContext) reply(msg string) {
+	c.outbox.privmsg(c.conn, c.line.Nick, msg)
+}
+
+func (c *commandContext) replySyntax() {
+	c.reply("syntax: " + c.command.syntax())
+}
+
+// something went wrong on our end
+func (c *commandContext) fail(err error) {
+	log.Printf(".%s failed: %s", c.command.name, err)
+	c.reply("sorry, something went wrong on my end. try again later")
+}
+
+type commandSet struct {
+	commands []*command
+	names    map[string]*command
+}
+
+func newCommandSet() *commandSet {
+	return &commandSet{names: map[string]*command{}}
+}
+
+func (cs *commandSet) register(cmd *command) {
+	cs.commands = append(cs.commands, cmd)
+	cs.names[cmd.name] = cmd
+	for _, a := range cmd.aliases {
+		cs.names[a] = cmd
+	}
+}
+
+// the command a line starts with, if any, and the rest of the line
+func (cs *commandSet) lookup(text string) (*command, string) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, ".") {
+		return nil, ""
+	}
+	parts := strings.SplitN(text, " ", 2)
+	cmd := cs.names[strings.TrimPrefix(parts[0], ".")]
+	if cmd == nil || len(parts) == 1 {
+		return cmd, ""
+	}
+	return cmd, parts[1]
+}
+
+func (cs *commandSet) sortedNames() []string {
+	names := []string{}
+	for _, cmd := range cs.commands {
+		names = append(names, "."+cmd.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (cl *channelLogger) registerCommands() {
+	for _, cmd := range []*command{
+		{
+			name:  "help",
+			usage: []string{"", "command"},
+			help:  "lists the commands, or explains one",
+			args:  words(0, 1),
+			scope: anywhere,
+			run:   cl.helpCommand,
+		},
+		{
+			name:   "ack",
+			help:   "clears out the messages I've delivered to you",
+			args:   words(0, 0),
+			scope:  anywhere,
+			inline: true,
+			run:    cl.ackCommand,
+		},
+		{
+			name:  "url",
+			usage: []string{"http://example.com/ title for link"},
+			help:  "saves a link to the links page",
+			args:  wordsThenRest(1),
+			scope: inChannel,
+			run:   cl.urlCommand,
+		},
+		{
+			name:  "tell",
+			usage: []string{"nick message"},
+			help:  "leaves someone a message for the next time they're around",
+			args:  wordsThenRest(1),
+			scope: anywhere,
+			run:   cl.tellCommand,
+		},
+		{
+			name:  "tells",
+			help:  "lists your messages that haven't been delivered yet",
+			args:  words(0, 0),
+			scope: anywhere,
+			run:   cl.tellsCommand,
+		},
+		{
+			name:  "untell",
+			usage: []string{"N"},
+			help:  "cancels one of your messages (see .tells for the numbers)",
+			args:  words(1, 1),
+			scope: anywhere,
+			run:   cl.untellCommand,
+		},
+		{
+			name:  "alias",
+			usage: []string{"add name", "remove name", "list"},
+			help:  "other names that mentions of you go by",
+			args:  words(1, 2),
+			scope: anywhere,
+			run:   cl.aliasCommand,
+		},
+		{
+			name:  "email",
+			usage: []string{"set me@example.com", "off"},
+			help:  "emails you when you're mentioned while you're away (same as .handle set email)",
+			args:  words(1, 2),
+			perm:  identified,
+			scope: anywhere,
+			run:   cl.emailCommand,
+		},
+		{
+			name:  "handle",
+			usage: []string{"set service handle", "remove service", "show [nick]"},
+			help:  "your names elsewhere (twitter, mastodon, github, email), so you get credited when your links go out. set and remove need you to be identified with NickServ",
+			args:  words(1, 3),
+			scope: anywhere,
+			run:   cl.handleCommand,
+		},
+		{
+			name:  "op",
+			usage: []string{"add nick", "remove nick", "list", "log"},
+			help:  "manages who gets opped when they join",
+			args:  words(1, 2),
+			perm:  adminsOnly,
+			scope: anywhere,
+			run:   cl.opCommand,
+		},
+		{
+			name:  "tweet",
+			usage: []string{"some text", "confirm", "cancel"},
+			help:  "posts to the channel's twitter account, once you've confirmed it",
+			args:  wordsThenRest(0),
+			perm:  tweetersOnly,
+			scope: anywhere,
+			run:   cl.tweetCommand,
+		},
+	} {
+		cl.commands.register(cmd)
+	}
+}
+
+// whether the line is one of our commands, whether or not it gets to
+// run
+func (cl *channelLogger) isCommand(line *irc.Line) bool {
+	cmd, _ := cl.commands.lookup(line.Text())
+	return line.Cmd == "PRIVMSG" && cmd != nil
+}
+
+// runs the line as a command, if it is one. channel is empty for a
+// private message. returns true if nothing else should be done with
+// the line
+func (cl *channelLogger) dispatch(conn *irc.Conn, channel string, line *irc.Line) bool {
+	if line.Cmd != "PRIVMSG" {
+		return false
+	}
+	cmd, rest := cl.commands.lookup(line.Text())
+	if cmd == nil {
+		return false
+	}
+	c := &commandContext{command: cmd, outbox: cl.site.outbox, conn: conn, line: line, channel: channel}
+	if channel == "" && cmd.scope&inPrivate == 0 {
+		c.reply(fmt.Sprintf(".%s only works in the channel", cmd.name))
+		return cmd.inline
+	}
+	if channel != "" && cmd.scope&inChannel == 0 {
+		c.reply(fmt.Sprintf(".%s only works in a private message", cmd.name))
+		return cmd.inline
+	}
+	o := cl.site.ops
+	if cmd.perm == adminsOnly && (o == nil || !o.isAdmin(line.Nick)) {
+		c.reply(fmt.Sprintf("sorry, only admins can use .%s", cmd.name))
+		return cmd.inline
+	}
+	if cmd.perm == tweetersOnly && (o == nil || !cl.site.tweeters.allowed(line.Nick)) {
+		c.reply(fmt.Sprintf("sorry, you're not on the list for .%s", cmd.name))
+		return cmd.inline
+	}
+	if cmd.perm == identified && o == nil {
+		c.reply(fmt.Sprintf("sorry, I can't check who you are for .%s", cmd.name))
+		return cmd.inline
+	}
+	args, ok := cmd.args(rest)
+	if !ok {
+		c.replySyntax()
+		return cmd.inline
+	}
+	c.args = args
+
+	if cmd.perm != anyone {
+		cl.whenPermitted(c, cmd.perm, func() { cmd.run(c) })
+		return cmd.inline
+	}
+	if cmd.inline {
+		cmd.run(c)
+		return true
+	}
+	cl.background(func() { cmd.run(c) })
+	return false
+}
+
+func (cl *channelLogger) permitted(perm permission, nick, account string) bool {
+	switch perm {
+	case adminsOnly:
+		return cl.site.ops.isAdmin(account)
+	case tweetersOnly:
+		return cl.site.tweeters.allowed(account)
+	case identified:
+		return strings.EqualFold(normalizeNick(nick), normalizeNick(account))
+	}
+	return true
+}
+
+// make sure it's really them, then run f in the background. the
+// dispatcher does this for commands that need it, and commands can use
+// it for the forms that do
+func (cl *channelLogger) whenPermitted(c *commandContext, perm permission, f func()) {
+	cl.site.ops.whois(c.conn, c.line.Nick, func(account string) {
+		if account == "" || !cl.permitted(perm, c.line.Nick, account) {
+			c.reply("you need to identify with NickServ first")
+			return
+		}
+		cl.background(f)
+	})
+}
+
+func (cl *channelLogger) helpCommand(c *commandContext) {
+	if len(c.args) == 0 {
+		c.reply("commands: " + strings.Join(cl.commands.sortedNames(), ", "))
+		c.reply("say .help command to find out more about one")
+		return
+	}
+	cmd := cl.commands.names[strings.TrimPrefix(c.args[0], ".")]
+	if cmd == nil {
+		c.reply(fmt.Sprintf("I don't know a .%s command", strings.TrimPrefix(c.args[0], ".")))
+		return
+	}
+	c.reply(cmd.syntax() + ": " + cmd.help)
+	notes := []string{}
+	if len(cmd.aliases) > 0 {
+		notes = append(notes, "also ."+strings.Join(cmd.aliases, ", ."))
+	}
+	switch cmd.scope {
+	case inChannel:
+		notes = append(notes, "only in the channel")
+	case inPrivate:
+		notes = append(notes, "only in a private message")
+	}
+	switch cmd.perm {
+	case adminsOnly:
+		notes = append(notes, "admins only")
+	case tweetersOnly:
+		notes = append(notes, "only for the people on the list")
+	case identified:
+		notes = append(notes, "you need to be identified with NickServ")
+	}
+	if len(notes) > 0 {
+		c.reply("(" + strings.Join(notes, "; ") + ")")
+	}
+}
+
+func (cl *channelLogger) ackCommand(c *commandContext) {
+	n, err := cl.site.acknowledgeMessages(c.line.Nick)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.reply(fmt.Sprintf("ok, cleared %d messages", n))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_argParsers(t *testing.T) {
+	if args, ok := words(1, 2)("add  bob"); !ok || len(args) != 2 || args[1] != "bob" {
+		t.Error(args, ok)
+	}
+	if _, ok := words(1, 2)(""); ok {
+		t.Error("not enough words")
+	}
+	if _, ok := words(0, 0)("extra"); ok {
+		t.Error("too many words")
+	}
+	args, ok := wordsThenRest(1)("bob  the build   is broken")
+	if !ok || len(args) != 2 || args[0] != "bob" || args[1] != "the build is broken" {
+		t.Error(args, ok)
+	}
+	if _, ok := wordsThenRest(1)("bob"); ok {
+		t.Error("there has to be something after the words")
+	}
+}
+
+func Test_commandSyntax(t *testing.T) {
+	cases := []struct {
+		cmd      command
+		expected string
+	}{
+		{command{name: "tells"}, ".tells"},
+		{command{name: "tell", usage: []string{"nick message"}}, ".tell nick message"},
+		{command{name: "help", usage: []string{"", "command"}}, ".help, or .help command"},
+		{command{name: "alias", usage: []string{"add name", "remove name", "list"}},
+			".alias add name, .alias remove name, or .alias list"},
+	}
+	for _, c := range cases {
+		if r := c.cmd.syntax(); r != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, r)
+		}
+	}
+}
+
+func Test_dispatch(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	cl := s.channelLogger
+	now := time.Now()
+
+	if cl.dispatch(conn, "#one", testLine("bob", "#one", "just chatting", now)) {
+		t.Error("not a command")
+	}
+	if cl.dispatch(conn, "#one", testLine("bob", "#one", ".nope", now)) {
+		t.Error("not a command either")
+	}
+
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".help", now))
+	if l := expectLine(t, lines, "PRIVMSG bob :commands:"); l != "PRIVMSG bob :commands: .ack, .alias, .email, .handle, .help, .op, .tell, .tells, .tweet, .untell, .url" {
+		t.Error(l)
+	}
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".help .url", now))
+	expectLine(t, lines, "PRIVMSG bob :.url http://example.com/ title for link: saves a link")
+	expectLine(t, lines, "PRIVMSG bob :(only in the channel)")
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".help frobnicate", now))
+	expectLine(t, lines, "PRIVMSG bob :I don't know a .frobnicate command")
+
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".url http://example.com/ a link", now))
+	expectLine(t, lines, "PRIVMSG bob :.url only works in the channel")
+	cl.dispatch(conn, "#one", testLine("bob", "#one", ".url http://example.com/", now))
+	expectLine(t, lines, "PRIVMSG bob :syntax: .url http://example.com/ title for link")
+	cl.dispatch(conn, "#one", testLine("bob", "#one", ".alias frob", now))
+	expectLine(t, lines, "PRIVMSG bob :syntax: .alias add name, .alias remove name, or .alias list")
+
+	// no admins configured, so nobody's an admin
+	cl.dispatch(conn, "#one", testLine("bob", "#one", ".op list", now))
+	expectLine(t, lines, "PRIVMSG bob :sorry, only admins can use .op")
+
+	// .ack is handled right away, and isn't logged
+	if !cl.dispatch(conn, "#one", testLine("bob", "#one", ".ack", now)) {
+		t.Error(".ack should be the end of it")
+	}
+	expectLine(t, lines, "PRIVMSG bob :ok, cleared 0 messages")
+}
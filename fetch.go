@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"golang.org/x/net/html"
+)
+
+// when it's turned on, frontdesk looks at any URL someone pastes in
+// a channel, says what the page is called, and saves it as a link.
+// we're fetching whatever people paste, so we're careful: pages have
+// to be small and quick, HTML, allowed by robots.txt, and not on our
+// own network.
+
+const (
+	fetchUserAgent = "frontdesk (+https://github.com/thraxil/frontdesk)"
+	fetchTimeout   = 5 * time.Second
+	fetchMaxBytes  = 512 * 1024
+	robotsTTL      = time.Hour
+	// how many sites' robots.txt we remember at once
+	robotsCacheSize = 1000
+	fetchRedirects  = 10
+)
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+var closingBrackets = map[byte]byte{')': '(', ']': '[', '}': '{'}
+
+// the first URL in a line, minus any punctuation that's probably
+// just the end of the sentence. a closing bracket stays if it closes
+// one in the URL, like https://en.wikipedia.org/wiki/Go_(programming_language)
+func findURL(text string) string {
+	u := urlPattern.FindString(text)
+	for u != "" {
+		last := u[len(u)-1]
+		if strings.IndexByte(".,;:!?'", last) != -1 {
+			u = u[:len(u)-1]
+			continue
+		}
+		open, ok := closingBrackets[last]
+		if ok && strings.Count(u, string(open)) < strings.Count(u, string(last)) {
+			u = u[:len(u)-1]
+			continue
+		}
+		break
+	}
+	return u
+}
+
+type pageInfo struct {
+	Title       string
+	Description string
+}
+
+type robotsRules struct {
+	disallow []string
+	fetched  time.Time
+}
+
+func (r robotsRules) allows(path string) bool {
+	for _, d := range r.disallow {
+		if strings.HasPrefix(path, d) {
+			return false
+		}
+	}
+	return true
+}
+
+type titleFetcher struct {
+	client *http.Client
+	// the same, but without checking robots.txt on redirects, or
+	// fetching robots.txt would need robots.txt
+	robotsClient *http.Client
+
+	mu     sync.Mutex
+	robots map[string]robotsRules
+}
+
+var errPrivateAddress = errors.New("not fetching from a private address")
+
+// refuse to connect anywhere on our own network, including after
+// redirects. allowPrivate turns that off, for tests
+func newTitleFetcher(allowPrivate bool) *titleFetcher {
+	dialer := &net.Dialer{Timeout: fetchTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+				ip.IsUnspecified() || ip.IsMulticast() {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	f := &titleFetcher{
+		client:       &http.Client{Timeout: fetchTimeout, Transport: transport},
+		robotsClient: &http.Client{Timeout: fetchTimeout, Transport: transport},
+		robots:       map[string]robotsRules{},
+	}
+	f.robotsClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= fetchRedirects {
+			return errors.New("too many redirects")
+		}
+		return nil
+	}
+	// wherever we get sent has to be OK with us too
+	f.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := f.robotsClient.CheckRedirect(req, via); err != nil {
+			return err
+		}
+		if !f.robotsFor(req.Context(), req.URL).allows(req.URL.EscapedPath()) {
+			return fmt.Errorf("robots.txt says not to fetch %s", req.URL)
+		}
+		return nil
+	}
+	return f
+}
+
+func (f *titleFetcher) get(ctx context.Context, client *http.Client, u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", fetchUserAgent)
+	return client.Do(req)
+}
+
+// what robots.txt says about everyone. we only look at the
+// "User-agent: *" section, and only at Disallow
+func (f *titleFetcher) robotsFor(ctx context.Context, u *url.URL) robotsRules {
+	key := u.Scheme + "://" + u.Host
+	f.mu.Lock()
+	r, ok := f.robots[key]
+	f.mu.Unlock()
+	if ok && time.Since(r.fetched) < robotsTTL {
+		return r
+	}
+
+	r = robotsRules{fetched: time.Now()}
+	resp, err := f.get(ctx, f.robotsClient, key+"/robots.txt")
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode == 200 {
+			r.disallow = parseRobots(io.LimitReader(resp.Body, fetchMaxBytes))
+		}
+	}
+	f.mu.Lock()
+	if len(f.robots) >= robotsCacheSize {
+		f.pruneRobots()
+	}
+	f.robots[key] = r
+	f.mu.Unlock()
+	return r
+}
+
+// make room in the robots.txt cache: everything that's out of date,
+// and if that isn't enough, whatever else. f.mu has to be held
+func (f *titleFetcher) pruneRobots() {
+	for k, r := range f.robots {
+		if time.Since(r.fetched) >= robotsTTL {
+			delete(f.robots, k)
+		}
+	}
+	for k := range f.robots {
+		if len(f.robots) < robotsCacheSize {
+			break
+		}
+		delete(f.robots, k)
+	}
+}
+
+func parseRobots(body io.Reader) []string {
+	disallow := []string{}
+	forUs := false
+	// a run of User-agent lines starts a new group
+	inAgents := false
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		switch field {
+		case "user-agent":
+			if !inAgents {
+				forUs = false
+			}
+			inAgents = true
+			if value == "*" {
+				forUs = true
+			}
+		case "disallow":
+			inAgents = false
+			if forUs && value != "" {
+				disallow = append(disallow, value)
+			}
+		default:
+			inAgents = false
+		}
+	}
+	return disallow
+}
+
+func (f *titleFetcher) fetch(u string) (pageInfo, error) {
+	var info pageInfo
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return info, fmt.Errorf("can't fetch %s", u)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	if !f.robotsFor(ctx, parsed).allows(parsed.EscapedPath()) {
+		return info, fmt.Errorf("robots.txt says not to fetch %s", u)
+	}
+	resp, err := f.get(ctx, f.client, u)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return info, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return info, fmt.Errorf("%s isn't a web page (%s)", u, mediaType)
+	}
+	return parsePage(io.LimitReader(resp.Body, fetchMaxBytes)), nil
+}
+
+// the title and description, preferring OpenGraph's if there are any
+func parsePage(body io.Reader) pageInfo {
+	var info, og pageInfo
+	z := html.NewTokenizer(body)
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// the end, or as much as we were willing to read
+			return mergePageInfo(og, info)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "meta":
+				attrs := map[string]string{}
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					attrs[string(k)] = string(v)
+				}
+				switch {
+				case attrs["property"] == "og:title":
+					og.Title = attrs["content"]
+				case attrs["property"] == "og:description":
+					og.Description = attrs["content"]
+				case strings.ToLower(attrs["name"]) == "description":
+					info.Description = attrs["content"]
+				}
+			case "body":
+				// everything we want is in the head
+				return mergePageInfo(og, info)
+			}
+		case html.TextToken:
+			if inTitle {
+				info.Title += string(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return mergePageInfo(og, info)
+			}
+		}
+	}
+}
+
+func mergePageInfo(preferred, fallback pageInfo) pageInfo {
+	if preferred.Title == "" {
+		preferred.Title = fallback.Title
+	}
+	if preferred.Description == "" {
+		preferred.Description = fallback.Description
+	}
+	preferred.Title = strings.Join(strings.Fields(preferred.Title), " ")
+	preferred.Description = strings.Join(strings.Fields(preferred.Description), " ")
+	return preferred
+}
+
+// look up a URL someone pasted, tell the channel what it is, and
+// save it
+func (cl *channelLogger) captureLink(conn *irc.Conn, channel string, line *irc.Line, u string) {
+	info, err := cl.site.fetcher.fetch(u)
+	if err != nil {
+		log.Println("couldn't fetch", u, err)
+		return
+	}
+	if info.Title == "" {
+		return
+	}
+	le := newLinkEntry(channel, line, u, info.Title)
+	le.Description = info.Description
+	le.Auto = true
+	stored, err := cl.site.storeNewLink(le)
+	if err != nil {
+		log.Println("couldn't save", u, err)
+		return
+	}
+	if !stored {
+		// somebody already saved it, title and all
+		return
+	}
+	cl.site.outbox.privmsg(conn, channel, fmt.Sprintf("^ %s (%s)", info.Title, linkDomain(u)))
+}
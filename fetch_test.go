@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_findURL(t *testing.T) {
+	cases := map[string]string{
+		"have you seen http://example.com/foo?":                         "http://example.com/foo",
+		"(https://example.com/a_b), it's good":                          "https://example.com/a_b",
+		"two: http://example.com/1 http://example.com/2":                "http://example.com/1",
+		"no links here, just example.com":                               "",
+		"<https://example.com/path?q=1&r=2#frag> he said":               "https://example.com/path?q=1&r=2#frag",
+		"see https://en.wikipedia.org/wiki/Go_(programming_language).":  "https://en.wikipedia.org/wiki/Go_(programming_language)",
+		"(see https://en.wikipedia.org/wiki/Go_(programming_language))": "https://en.wikipedia.org/wiki/Go_(programming_language)",
+		"[http://example.com/x]":                                        "http://example.com/x",
+	}
+	for text, expected := range cases {
+		if u := findURL(text); u != expected {
+			t.Errorf("%q: got %q, expected %q", text, u, expected)
+		}
+	}
+}
+
+func Test_robotsCacheSize(t *testing.T) {
+	f := newTitleFetcher(true)
+	for i := 0; i < robotsCacheSize; i++ {
+		f.robots[fmt.Sprintf("http://%d.example.com", i)] = robotsRules{fetched: time.Now()}
+	}
+	f.robots["http://old.example.com"] = robotsRules{fetched: time.Now().Add(-2 * robotsTTL)}
+	ts := titleServer()
+	defer ts.Close()
+	if _, err := f.fetch(ts.URL + "/page"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.robots) > robotsCacheSize {
+		t.Error(len(f.robots))
+	}
+	if _, ok := f.robots["http://old.example.com"]; ok {
+		t.Error("expired entries should go first")
+	}
+	u, _ := url.Parse(ts.URL)
+	if _, ok := f.robots["http://"+u.Host]; !ok {
+		t.Error("the new one should be there")
+	}
+}
+
+func Test_parseRobots(t *testing.T) {
+	robots := `# comments are fine
+User-agent: googlebot
+Disallow: /not-google
+
+User-agent: otherbot
+User-agent: *
+Disallow: /private # trailing comment
+Disallow:
+
+User-agent: somethingelse
+Disallow: /
+`
+	d := parseRobots(strings.NewReader(robots))
+	if len(d) != 1 || d[0] != "/private" {
+		t.Error(d)
+	}
+	r := robotsRules{disallow: d}
+	if r.allows("/private/thing") || !r.allows("/public") {
+		t.Error("wrong rules")
+	}
+}
+
+func Test_parsePage(t *testing.T) {
+	page := `<html><head>
+<title>
+  The   Title
+</title>
+<meta name="Description" content="plain description">
+<meta property="og:title" content="The OpenGraph Title" />
+</head><body><title>not this</title></body></html>`
+	info := parsePage(strings.NewReader(page))
+	if info.Title != "The OpenGraph Title" || info.Description != "plain description" {
+		t.Error(info)
+	}
+	info = parsePage(strings.NewReader("<title>just a title"))
+	if info.Title != "just a title" {
+		t.Error(info)
+	}
+}
+
+func titleServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><title>A Page</title>
+<meta property="og:description" content="what it's about"></head></html>`)
+	})
+	mux.HandleFunc("/nasty", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>&lt;script&gt;alert(1)&lt;/script&gt;</title>
+<meta name="description" content="<img src=x onerror=alert(2)>">`)
+	})
+	mux.HandleFunc("/private/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>Secret</title>`)
+	})
+	mux.HandleFunc("/cat.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "<title>not really html</title>")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>")
+		// a title that never ends. we should stop reading
+		w.Write([]byte(strings.Repeat("a", fetchMaxBytes*2)))
+	})
+	return httptest.NewServer(mux)
+}
+
+func Test_titleFetcher(t *testing.T) {
+	ts := titleServer()
+	defer ts.Close()
+	f := newTitleFetcher(true)
+
+	info, err := f.fetch(ts.URL + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Title != "A Page" || info.Description != "what it's about" {
+		t.Error(info)
+	}
+	if _, err := f.fetch(ts.URL + "/private/page"); err == nil {
+		t.Error("robots.txt should have stopped that")
+	}
+	if _, err := f.fetch(ts.URL + "/cat.png"); err == nil {
+		t.Error("that's not a web page")
+	}
+	if _, err := f.fetch(ts.URL + "/missing"); err == nil {
+		t.Error("404s should be an error")
+	}
+	if info, err := f.fetch(ts.URL + "/slow"); err != nil || len(info.Title) > fetchMaxBytes {
+		t.Error(len(info.Title), err)
+	}
+
+	// redirects to somewhere robots.txt rules out don't get followed
+	other := titleServer()
+	defer other.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/elsewhere", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/private/page", http.StatusFound)
+	})
+	mux.HandleFunc("/fine", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/page", http.StatusFound)
+	})
+	redirector := httptest.NewServer(mux)
+	defer redirector.Close()
+	if _, err := f.fetch(redirector.URL + "/elsewhere"); err == nil || !strings.Contains(err.Error(), "robots.txt") {
+		t.Error("robots.txt on the other host should have stopped that", err)
+	}
+	if info, err := f.fetch(redirector.URL + "/fine"); err != nil || info.Title != "A Page" {
+		t.Error(info, err)
+	}
+
+	// a robots.txt that redirects forever only gets followed so far,
+	// and fetching it doesn't go looking for robots.txt again
+	robotsHits := 0
+	loopy := http.NewServeMux()
+	loopy.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		robotsHits++
+		http.Redirect(w, r, "/robots.txt", http.StatusFound)
+	})
+	loopy.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/page", http.StatusFound)
+	})
+	loopyServer := httptest.NewServer(loopy)
+	defer loopyServer.Close()
+	if info, err := f.fetch(loopyServer.URL + "/moved"); err != nil || info.Title != "A Page" {
+		t.Error(info, err)
+	}
+	if robotsHits != fetchRedirects {
+		t.Error(robotsHits)
+	}
+
+	// the real thing won't go anywhere near localhost
+	if _, err := newTitleFetcher(false).fetch(ts.URL + "/page"); err == nil {
+		t.Error("shouldn't fetch from a private address")
+	}
+}
+
+func Test_captureLink(t *testing.T) {
+	ts := titleServer()
+	defer ts.Close()
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.fetcher = newTitleFetcher(true)
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+
+	now := time.Now()
+	s.channelLogger.Handle(conn, testLine("alice", "#one", "look: "+ts.URL+"/page.", now))
+	expectLine(t, lines, "PRIVMSG #one :^ A Page (127.0.0.1)")
+	s.channelLogger.wait()
+
+	links, _, _ := s.links(linkFilter{}, "", 10)
+	if len(links) != 1 || links[0].URL != ts.URL+"/page" || !links[0].Auto ||
+		links[0].Description != "what it's about" || links[0].Nick != "alice" {
+		t.Error(links)
+	}
+
+	// nothing to say about things we can't fetch
+	s.channelLogger.Handle(conn, testLine("alice", "#one", ts.URL+"/cat.png", now.Add(time.Second)))
+	s.channelLogger.wait()
+	if links, _, _ := s.links(linkFilter{}, "", 10); len(links) != 1 {
+		t.Error(links)
+	}
+
+	// commands aren't captured, so .url keeps the title it was given
+	later := now.Add(2 * time.Second)
+	s.channelLogger.Handle(conn, testLine("bob", "#one", ".url "+ts.URL+"/page bob's title", later))
+	expectLine(t, lines, "PRIVMSG bob :saved your link")
+	s.channelLogger.Handle(conn, testLine("bob", "#one", ".tell carol see "+ts.URL+"/page", later.Add(time.Second)))
+	s.channelLogger.wait()
+	links, _, _ = s.links(linkFilter{}, "", 10)
+	if len(links) != 2 || links[0].Title != "bob's title" || links[0].Auto {
+		t.Error(links)
+	}
+	// and a capture never replaces something already saved
+	le := newLinkEntry("#one", testLine("bob", "#one", "", later), ts.URL+"/page", "A Page")
+	if stored, err := s.storeNewLink(le); stored || err != nil {
+		t.Error(stored, err)
+	}
+}
+
+// titles come from whatever page someone pastes, so they'd better be
+// escaped everywhere we show them
+func Test_capturedLinksEscaped(t *testing.T) {
+	ts := titleServer()
+	defer ts.Close()
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.fetcher = newTitleFetcher(true)
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+
+	s.channelLogger.Handle(conn, testLine("alice", "#one", ts.URL+"/nasty", time.Now()))
+	expectLine(t, lines, "PRIVMSG #one :^ <script>alert(1)</script>")
+	s.channelLogger.wait()
+
+	for _, path := range []string{"/links/", "/links/by/alice/"} {
+		w := httptest.NewRecorder()
+		linksHandler(w, httptest.NewRequest("GET", path, nil), s)
+		body := w.Body.String()
+		if strings.Contains(body, "<script>alert") || strings.Contains(body, "<img src=x") {
+			t.Error(path, body)
+		}
+		if !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+			t.Error(path, body)
+		}
+	}
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search/?q=alert&type=links", nil), s)
+	if body := w.Body.String(); strings.Contains(body, "<script>alert") || !strings.Contains(body, "&lt;script&gt;") {
+		t.Error(body)
+	}
+}
@@ -1,23 +1,50 @@
 package main // import "github.com/thraxil/frontdesk"
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	auth "github.com/abbot/go-http-auth"
 	"github.com/blevesearch/bleve"
 	"github.com/boltdb/bolt"
+	"github.com/emersion/go-sasl"
 	irc "github.com/fluffle/goirc/client"
 	"github.com/kelseyhightower/envconfig"
 )
 
 type config struct {
-	Channel string
-	Nick    string
+	// comma separated, eg "#foo,#bar"
+	Channels []string `envconfig:"CHANNEL"`
+	Nick     string
+
+	Server      string `default:"irc.freenode.net"`
+	IRCPort     int    `envconfig:"PORT_IRC"`
+	TLS         bool
+	TLSInsecure bool   `envconfig:"TLS_INSECURE"`
+	ServerPass  string `envconfig:"SERVER_PASS"`
+	TLSCert     string `envconfig:"TLS_CERT"`
+	TLSKey      string `envconfig:"TLS_KEY"`
+
+	SASLMech     string `envconfig:"SASL_MECH"`
+	SASLUser     string `envconfig:"SASL_USER"`
+	SASLPass     string `envconfig:"SASL_PASS"`
+	NickServPass string `envconfig:"NICKSERV_PASS"`
+
+	// nicks that can manage the ops list
+	Admins []string
+	// nicks that can use .tweet
+	Tweeters []string
 
 	DBPath    string `envconfig:"DB_PATH"`
 	BlevePath string `envconfig:"BLEVE_PATH"`
@@ -27,22 +54,105 @@ type config struct {
 	HtpasswdFile string `envconfig:"HTPASSWD"`
 	HandleFile   string `envconfig:"HANDLE_FILE"`
 
+	// bitly, post or builtin. bitly if there's a token and this
+	// isn't set
+	Shortener             string `envconfig:"SHORTENER"`
+	ShortenerURL          string `envconfig:"SHORTENER_URL"`
+	ShortenerField        string `envconfig:"SHORTENER_FIELD"`
 	BitlyAccessToken      string `envconfig:"BITLY_ACCESS_TOKEN"`
 	TwitterOauthToken     string `envconfig:"TWITTER_OAUTH_TOKEN"`
 	TwitterOauthSecret    string `envconfig:"TWITTER_OAUTH_SECRET"`
 	TwitterConsumerKey    string `envconfig:"TWITTER_CONSUMER_KEY"`
 	TwitterConsumerSecret string `envconfig:"TWITTER_CONSUMER_SECRET"`
+
+	MastodonURL      string `envconfig:"MASTODON_URL"`
+	MastodonToken    string `envconfig:"MASTODON_TOKEN"`
+	WebhookURL       string `envconfig:"WEBHOOK_URL"`
+	SlackWebhookURL  string `envconfig:"SLACK_WEBHOOK_URL"`
+	MatrixHomeserver string `envconfig:"MATRIX_HOMESERVER"`
+	MatrixToken      string `envconfig:"MATRIX_TOKEN"`
+	MatrixRoom       string `envconfig:"MATRIX_ROOM"`
+
+	SMTPHost string `envconfig:"SMTP_HOST"`
+	SMTPPort int    `envconfig:"SMTP_PORT" default:"25"`
+	SMTPUser string `envconfig:"SMTP_USER"`
+	SMTPPass string `envconfig:"SMTP_PASS"`
+	SMTPFrom string `envconfig:"SMTP_FROM"`
+	// minutes
+	EmailInterval int `envconfig:"EMAIL_INTERVAL" default:"15"`
+
+	// look up and save any URL someone pastes
+	FetchTitles bool `envconfig:"FETCH_TITLES"`
+
+	QuitMessage string `envconfig:"QUIT_MESSAGE" default:"front desk is closing up"`
+	// minutes without hearing anything before the smoketest fails.
+	// 0 turns the check off
+	SmoketestWindow int `envconfig:"SMOKETEST_WINDOW" default:"1440"`
 }
 
 var backoff = 0
 var maxBackoff = 9
 
+// build the goirc config from ours. if no IRC port is given,
+// we use the standard one for plaintext or TLS
+func newIRCConfig(cfg config) (*irc.Config, error) {
+	port := cfg.IRCPort
+	if port == 0 {
+		port = 6667
+		if cfg.TLS {
+			port = 6697
+		}
+	}
+	ic := irc.NewConfig(cfg.Nick)
+	ic.Server = net.JoinHostPort(cfg.Server, strconv.Itoa(port))
+	ic.Pass = cfg.ServerPass
+	if cfg.TLS {
+		ic.SSL = true
+		ic.SSLConfig = &tls.Config{
+			ServerName:         cfg.Server,
+			InsecureSkipVerify: cfg.TLSInsecure,
+		}
+		if cfg.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+			if err != nil {
+				return nil, err
+			}
+			ic.SSLConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	saslUser := cfg.SASLUser
+	if saslUser == "" {
+		saslUser = cfg.Nick
+	}
+	switch strings.ToUpper(cfg.SASLMech) {
+	case "":
+		// no SASL
+	case "PLAIN":
+		if cfg.SASLPass == "" {
+			return nil, errors.New("SASL PLAIN needs a password")
+		}
+		ic.Sasl = sasl.NewPlainClient("", saslUser, cfg.SASLPass)
+	case "EXTERNAL":
+		if !cfg.TLS || cfg.TLSCert == "" {
+			return nil, errors.New("SASL EXTERNAL needs TLS and a client certificate")
+		}
+		ic.Sasl = sasl.NewExternalClient("")
+	default:
+		return nil, fmt.Errorf("unknown SASL mechanism: %s", cfg.SASLMech)
+	}
+	if ic.Sasl != nil {
+		ic.EnableCapabilityNegotiation = true
+	}
+	return ic, nil
+}
+
 func retryConnect(c *irc.Conn) error {
 	backoffSecs := time.Duration(
 		math.Pow(2, math.Min(float64(backoff), float64(maxBackoff))))
 	time.Sleep(backoffSecs * time.Second)
 	// connect to irc
-	if err := c.ConnectTo("irc.freenode.net"); err != nil {
+	if err := c.Connect(); err != nil {
 		log.Println("connection attempt", backoff, err.Error())
 		backoff++
 		return err
@@ -51,8 +161,14 @@ func retryConnect(c *irc.Conn) error {
 	return nil
 }
 
-func connect(c *irc.Conn) {
+// keep trying until we get through, or until we're told to stop
+func connect(c *irc.Conn, stopping chan struct{}) {
 	for {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
 		err := retryConnect(c)
 		if err == nil {
 			return
@@ -71,7 +187,6 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	index, err := bleve.Open(cfg.BlevePath)
 	if err == bleve.ErrorIndexPathDoesNotExist {
@@ -90,9 +205,13 @@ func main() {
 		log.Println("opening existing index")
 	}
 
-	c := irc.SimpleClient(cfg.Nick)
+	ic, err := newIRCConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := irc.Client(ic)
 
-	s := newSite(db, index, c, cfg.Channel, cfg.BaseURL, cfg.HtpasswdFile,
+	s := newSite(db, index, c, cfg.Channels, cfg.BaseURL, cfg.HtpasswdFile,
 		cfg.HandleFile,
 
 		cfg.BitlyAccessToken,
@@ -100,26 +219,94 @@ func main() {
 		cfg.TwitterOauthToken, cfg.TwitterOauthSecret,
 		cfg.TwitterConsumerKey, cfg.TwitterConsumerSecret,
 	)
+	s.nickAuth = newNickAuth(cfg.Nick, cfg.SASLMech, cfg.NickServPass)
+	s.ops = newOps(s, cfg.Admins)
+	s.tweeters = newTweeters(s, cfg.Tweeters)
+	s.health = newHealth(time.Duration(cfg.SmoketestWindow) * time.Minute)
+	// twitter is set up by newSite. everything else that links get
+	// sent on to
+	if cfg.MastodonURL != "" {
+		s.publishers = append(s.publishers, mastodonPublisher{cfg.MastodonURL, cfg.MastodonToken})
+	}
+	if cfg.WebhookURL != "" {
+		s.publishers = append(s.publishers, webhookPublisher{cfg.WebhookURL, s})
+	}
+	if cfg.SlackWebhookURL != "" {
+		s.publishers = append(s.publishers, slackPublisher{cfg.SlackWebhookURL, s})
+	}
+	if cfg.MatrixHomeserver != "" {
+		s.publishers = append(s.publishers, matrixPublisher{cfg.MatrixHomeserver, cfg.MatrixToken, cfg.MatrixRoom})
+	}
+	if cfg.FetchTitles {
+		s.fetcher = newTitleFetcher(false)
+	}
+	if cfg.Shortener != "" {
+		s.shortener, err = newShortener(cfg, s)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.SMTPHost != "" {
+		s.mailer = newMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPass,
+			cfg.SMTPFrom, cfg.BaseURL, time.Duration(cfg.EmailInterval)*time.Minute)
+	}
 
 	// setup IRC handlers
 	c.HandleFunc("connected", func(conn *irc.Conn, line *irc.Line) {
-		conn.Join(cfg.Channel)
-		log.Println("connected to the channel", cfg.Channel, "as", cfg.Nick)
+		s.nickAuth.identify(conn)
+		for _, channel := range s.channels {
+			conn.Join(channel)
+			log.Println("connected to the channel", channel, "as", cfg.Nick)
+		}
 		s.userLogger.start()
 	})
 
 	c.HandleFunc("disconnected", func(conn *irc.Conn, line *irc.Line) {
 		log.Println("disconnecting")
 		s.userLogger.stop()
-		connect(c)
+		s.nickAuth.reset()
+		s.health.reset()
+		s.ops.reset()
+		if s.isStopping() {
+			s.markDisconnected()
+			return
+		}
+		reconnects.Inc()
+		connect(c, s.stopping)
 	})
 
 	// this is the handler that gets triggered whenever someone posts
 	// in the channel
 	c.Handle("PRIVMSG", s.channelLogger)
 
-	// 353 is the response to a NAMES query
-	c.Handle("353", s.userLogger)
+	// and these are the other things that show up in the logs
+	for _, cmd := range []string{"ACTION", "JOIN", "PART", "KICK", "TOPIC", "MODE"} {
+		c.Handle(cmd, s.channelLogger)
+	}
+
+	// keep track of who's in the channels. 353 and 366 are the
+	// response to a NAMES query
+	for _, cmd := range []string{"JOIN", "PART", "QUIT", "KICK", "NICK", "353", "366"} {
+		c.Handle(cmd, s.userLogger)
+	}
+
+	// SASL results and NickServ responses, so we know whether
+	// we managed to identify
+	for _, cmd := range []string{"900", "902", "903", "904", "905", "906", "NOTICE"} {
+		c.Handle(cmd, s.nickAuth)
+	}
+
+	// auto-op anyone on the ops list when they join. 330, 307 and
+	// 318 are WHOIS replies, which tell us if they've identified
+	for _, cmd := range []string{"JOIN", "330", "307", "318"} {
+		c.Handle(cmd, s.ops)
+	}
+
+	// for the smoketest: which channels we're in, and when we last
+	// heard anything
+	for _, cmd := range []string{"PRIVMSG", "ACTION", "JOIN", "PART", "KICK", "TOPIC", "MODE", "QUIT", "NICK"} {
+		c.Handle(cmd, s.health)
+	}
 
 	// a bunch more IRC commands that we just want to print
 	// to the console if we see them
@@ -133,44 +320,181 @@ func main() {
 	}
 
 	// set up our web handlers
-	http.HandleFunc("/", makeHandler(indexHandler, s))
+	http.HandleFunc("/", makeHandler("index", indexHandler, s))
+	// the API can get at everything in the logs, so it needs the
+	// same protection
+	protect := func(h http.HandlerFunc) http.HandlerFunc { return h }
 	if s.HtpasswdFile != "" {
 		log.Println("authentication needed")
 		secretProvider := auth.HtpasswdFileProvider(s.HtpasswdFile)
 		authenticator := auth.NewBasicAuthenticator("frontdesk", secretProvider)
-		http.HandleFunc("/logs/", authenticator.Wrap(makeAuthHandler(logsAuthHandler, s)))
+		http.HandleFunc("/logs/", authenticator.Wrap(makeAuthHandler("logs", logsAuthHandler, s)))
+		protect = func(h http.HandlerFunc) http.HandlerFunc {
+			return authenticator.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+				h(w, &r.Request)
+			})
+		}
 	} else {
-		http.HandleFunc("/logs/", makeHandler(logsHandler, s))
+		http.HandleFunc("/logs/", makeHandler("logs", logsHandler, s))
 	}
-	http.HandleFunc("/links/", makeHandler(linksHandler, s))
-	http.HandleFunc("/links/feed/", makeHandler(linksFeedHandler, s))
-	http.HandleFunc("/search/", makeHandler(searchHandler, s))
-	http.HandleFunc("/smoketest/", makeHandler(smoketestHandler, s))
+	http.HandleFunc("/api/v1/logs/", protect(makeHandler("api_logs", apiLogsHandler, s)))
+	http.HandleFunc("/api/v1/years", protect(makeHandler("api_years", apiYearsHandler, s)))
+	http.HandleFunc("/api/v1/links", protect(makeHandler("api_links", apiLinksHandler, s)))
+	http.HandleFunc("/api/v1/mentions/", protect(makeHandler("api_mentions", apiMentionsHandler, s)))
+	http.HandleFunc("/api/v1/search", protect(makeHandler("api_search", apiSearchHandler, s)))
+	http.HandleFunc("/api/v1/nicks", protect(makeHandler("api_nicks", apiNicksHandler, s)))
+	http.HandleFunc("/links/", makeHandler("links", linksHandler, s))
+	http.HandleFunc("/links/feed/", makeHandler("links_feed", linksFeedHandler, s))
+	http.HandleFunc("/tweets/", makeHandler("tweets", tweetsHandler, s))
+	http.HandleFunc("/s/", makeHandler("short_link", shortLinkHandler, s))
+	http.HandleFunc("/search/", makeHandler("search", searchHandler, s))
+	http.HandleFunc("/smoketest/", makeHandler("smoketest", smoketestHandler, s))
+	http.Handle("/metrics", metricsHandler(s))
 	http.HandleFunc("/favicon.ico", faviconHandler)
 
+	// anything that couldn't be stored last time, or can't be from
+	// now on
+	go s.channelLogger.runSpool()
+
+	// links saved before they were searchable. in the background, so
+	// shutdown waits for it before closing the index
+	s.channelLogger.background(func() {
+		if err := s.backfillLinkIndex(); err != nil {
+			log.Println("couldn't index links:", err)
+		}
+	})
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
 	// connect to irc
-	connect(c)
+	go connect(c, s.stopping)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), nil))
+	// wait until we're asked to stop, then clean up after ourselves
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("got", <-sigs)
+	s.shutdown(c, srv, cfg.QuitMessage)
 }
 
+// the kinds of things that end up in the logs. lines logged before
+// we kept track of this have no Kind and are all messages
+const (
+	kindMessage = "message"
+	kindAction  = "action"
+	kindJoin    = "join"
+	kindPart    = "part"
+	kindQuit    = "quit"
+	kindNick    = "nick"
+	kindTopic   = "topic"
+	kindKick    = "kick"
+	kindMode    = "mode"
+)
+
 type lineEntry struct {
 	Nick      string
 	Text      string
 	Timestamp time.Time
+	Channel   string
+	Kind      string
+}
+
+func (l lineEntry) IsMessage() bool {
+	return l.Kind == "" || l.Kind == kindMessage
+}
+
+func (l lineEntry) IsAction() bool {
+	return l.Kind == kindAction
+}
+
+// people coming and going, which is noise most of the time
+func (l lineEntry) IsMembership() bool {
+	switch l.Kind {
+	case kindJoin, kindPart, kindQuit, kindNick:
+		return true
+	}
+	return false
+}
+
+// only things people actually said are worth searching
+func (l lineEntry) Searchable() bool {
+	return l.IsMessage() || l.IsAction() || l.Kind == kindTopic
+}
+
+// how anything other than a message shows up in the logs
+func (l lineEntry) EventText() string {
+	switch l.Kind {
+	case kindAction:
+		return "* " + l.Nick + " " + l.Text
+	case kindJoin:
+		return l.Nick + " has joined"
+	case kindPart:
+		return withReason(l.Nick+" has left", l.Text)
+	case kindQuit:
+		return withReason(l.Nick+" has quit", l.Text)
+	case kindNick:
+		return l.Nick + " is now known as " + l.Text
+	case kindTopic:
+		return l.Nick + " changed the topic to: " + l.Text
+	case kindKick:
+		return l.Nick + " kicked " + l.Text
+	case kindMode:
+		return l.Nick + " sets mode " + l.Text
+	}
+	return l.Text
+}
+
+func withReason(s, reason string) string {
+	if reason == "" {
+		return s
+	}
+	return s + " (" + reason + ")"
 }
 
 func (l lineEntry) Key() string {
 	return l.Timestamp.Format(time.RFC3339Nano)
 }
 
+// the ID for the line in the search index. Keys are only unique
+// within a channel
+func (l lineEntry) DocID() string {
+	if l.Channel == "" {
+		return l.Key()
+	}
+	return l.Channel + " " + l.Key()
+}
+
+// so the search index uses the "line" mapping, and keeps the channel
+// whole rather than analyzing it like text
+func (l lineEntry) Type() string {
+	return "line"
+}
+
 func (l lineEntry) NiceTime() string {
 	return l.Timestamp.Format("15:04:05")
 }
 
 func (l lineEntry) Permalink() string {
-	return fmt.Sprintf("/logs/%04d/%02d/%02d/#%s", l.Timestamp.Year(),
-		l.Timestamp.Month(), l.Timestamp.Day(), l.Key())
+	return dayURL(l.Channel, l.Timestamp.Year(), int(l.Timestamp.Month()),
+		l.Timestamp.Day()) + "#" + l.Key()
+}
+
+// channels go in URLs without their leading '#'. entries stored
+// before we supported multiple channels don't have one at all, and
+// get the old style URL, which goes to the default channel
+func channelSlug(channel string) string {
+	return strings.TrimLeft(channel, "#&+!")
+}
+
+func dayURL(channel string, year, month, day int) string {
+	if channel == "" {
+		return fmt.Sprintf("/logs/%04d/%02d/%02d/", year, month, day)
+	}
+	return fmt.Sprintf("/logs/%s/%04d/%02d/%02d/", channelSlug(channel), year, month, day)
 }
 
 // IRC likes to rename 'foo' to 'foo_', etc.
@@ -179,16 +503,18 @@ func normalizeNick(n string) string {
 	return strings.TrimRight(n, "_")
 }
 
-func makeHandler(fn func(http.ResponseWriter, *http.Request, *site), s *site) http.HandlerFunc {
+func makeHandler(name string, fn func(http.ResponseWriter, *http.Request, *site), s *site) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s %s\n", r.Method, r.URL.String())
+		defer observe(name, time.Now())
 		fn(w, r, s)
 	}
 }
 
-func makeAuthHandler(fn func(http.ResponseWriter, *auth.AuthenticatedRequest, *site), s *site) auth.AuthenticatedHandlerFunc {
+func makeAuthHandler(name string, fn func(http.ResponseWriter, *auth.AuthenticatedRequest, *site), s *site) auth.AuthenticatedHandlerFunc {
 	return func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		log.Printf("%s %s\n", r.Method, r.URL.String())
+		defer observe(name, time.Now())
 		fn(w, r, s)
 	}
 }
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	irc "github.com/fluffle/goirc/client"
 )
 
 func Test_lineEntryKey(t *testing.T) {
@@ -50,3 +56,146 @@ func Test_normalizeNick(t *testing.T) {
 		}
 	}
 }
+
+func Test_newIRCConfig(t *testing.T) {
+	ic, _ := newIRCConfig(config{Nick: "frontdesk", Server: "irc.example.com"})
+	if ic.Server != "irc.example.com:6667" {
+		t.Error(ic.Server)
+	}
+	if ic.SSL {
+		t.Error("shouldn't be using TLS")
+	}
+
+	ic, _ = newIRCConfig(config{Nick: "frontdesk", Server: "irc.example.com",
+		TLS: true, TLSInsecure: true, ServerPass: "sekrit"})
+	if ic.Server != "irc.example.com:6697" {
+		t.Error(ic.Server)
+	}
+	if !ic.SSL || ic.SSLConfig == nil {
+		t.Fatal("should be using TLS")
+	}
+	if ic.SSLConfig.ServerName != "irc.example.com" || !ic.SSLConfig.InsecureSkipVerify {
+		t.Error("bad TLS config")
+	}
+	if ic.Pass != "sekrit" {
+		t.Error(ic.Pass)
+	}
+
+	ic, _ = newIRCConfig(config{Nick: "frontdesk", Server: "irc.example.com", IRCPort: 7000})
+	if ic.Server != "irc.example.com:7000" {
+		t.Error(ic.Server)
+	}
+}
+
+func Test_newIRCConfigSASL(t *testing.T) {
+	ic, err := newIRCConfig(config{Nick: "frontdesk", Server: "irc.example.com",
+		SASLMech: "plain", SASLPass: "sekrit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ic.Sasl == nil || !ic.EnableCapabilityNegotiation {
+		t.Error("SASL should be enabled")
+	}
+
+	_, err = newIRCConfig(config{Nick: "frontdesk", Server: "irc.example.com",
+		SASLMech: "PLAIN"})
+	if err == nil {
+		t.Error("PLAIN without a password should be an error")
+	}
+
+	_, err = newIRCConfig(config{Nick: "frontdesk", Server: "irc.example.com",
+		SASLMech: "EXTERNAL"})
+	if err == nil {
+		t.Error("EXTERNAL without a client cert should be an error")
+	}
+
+	_, err = newIRCConfig(config{Nick: "frontdesk", Server: "irc.example.com",
+		SASLMech: "SCRAM-SHA-1"})
+	if err == nil {
+		t.Error("unknown mechanism should be an error")
+	}
+}
+
+// a minimal stand-in for an IRC server. it accepts a single client and
+// sends every line it receives down the returned channel
+func fakeIRCServer(t *testing.T) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- strings.TrimRight(l, "\r\n")
+		}
+	}()
+	return ln, lines
+}
+
+func expectLine(t *testing.T, lines chan string, prefix string) string {
+	for {
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", prefix)
+			}
+			if strings.HasPrefix(l, prefix) {
+				return l
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", prefix)
+		}
+	}
+}
+
+func Test_retryConnect(t *testing.T) {
+	ln, lines := fakeIRCServer(t)
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	ic, _ := newIRCConfig(config{Nick: "frontdesk", Server: host,
+		IRCPort: p, ServerPass: "sekrit"})
+	c := irc.Client(ic)
+	if err := retryConnect(c); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if backoff != 0 {
+		t.Error("backoff should be reset")
+	}
+	if l := expectLine(t, lines, "PASS"); l != "PASS sekrit" {
+		t.Error(l)
+	}
+	if l := expectLine(t, lines, "NICK"); l != "NICK frontdesk" {
+		t.Error(l)
+	}
+}
+
+// an irc connection to a fake server, for things that need to send
+func newTestConn(t *testing.T) (*irc.Conn, chan string, func()) {
+	ln, lines := fakeIRCServer(t)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	ic, _ := newIRCConfig(config{Nick: "frontdesk", Server: host, IRCPort: p})
+	ic.Flood = true
+	c := irc.Client(ic)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return c, lines, func() {
+		c.Close()
+		ln.Close()
+	}
+}
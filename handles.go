@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// people's names elsewhere, so we can credit them, eg "via @alice"
+// when their link is tweeted, and the address mention emails go to.
+// the "handles" bucket maps each (lowercased) nick to a JSON object of
+// service -> handle. people set their own with .handle, and the old
+// HANDLE_FILE CSV of nick,twitter gets copied in the first time we
+// start up with it set. the "meta" bucket remembers that it's been
+// done.
+
+var handleServices = []string{"twitter", "mastodon", "github", "email"}
+
+var (
+	twitterHandlePattern  = regexp.MustCompile(`^[A-Za-z0-9_]{1,15}$`)
+	mastodonHandlePattern = regexp.MustCompile(`^[A-Za-z0-9_]+@[A-Za-z0-9.-]+\.[A-Za-z]+$`)
+	githubHandlePattern   = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9]|-[A-Za-z0-9]){0,38}$`)
+)
+
+func handleKey(nick string) []byte {
+	return []byte(strings.ToLower(normalizeNick(nick)))
+}
+
+// tidies up a handle for a service (no @ on the front of twitter
+// handles, etc.), or complains if it doesn't look right
+func cleanHandle(service, handle string) (string, error) {
+	switch service {
+	case "twitter":
+		handle = strings.TrimPrefix(handle, "@")
+		if !twitterHandlePattern.MatchString(handle) {
+			return "", errors.New("that doesn't look like a twitter handle")
+		}
+	case "mastodon":
+		handle = strings.TrimPrefix(handle, "@")
+		if !mastodonHandlePattern.MatchString(handle) {
+			return "", errors.New("mastodon handles look like @you@example.social")
+		}
+		handle = "@" + handle
+	case "github":
+		if !githubHandlePattern.MatchString(handle) {
+			return "", errors.New("that doesn't look like a github username")
+		}
+	case "email":
+		a, err := mail.ParseAddress(handle)
+		if err != nil || a.Address != handle {
+			return "", errors.New("that doesn't look like an email address")
+		}
+	default:
+		return "", fmt.Errorf("I only know about %s", strings.Join(handleServices, ", "))
+	}
+	return handle, nil
+}
+
+func getHandles(tx *bolt.Tx, nick string) (map[string]string, error) {
+	handles := map[string]string{}
+	v := tx.Bucket([]byte("handles")).Get(handleKey(nick))
+	if v == nil {
+		return handles, nil
+	}
+	err := json.Unmarshal(v, &handles)
+	return handles, err
+}
+
+func putHandles(tx *bolt.Tx, nick string, handles map[string]string) error {
+	b := tx.Bucket([]byte("handles"))
+	if len(handles) == 0 {
+		return b.Delete(handleKey(nick))
+	}
+	data, err := json.Marshal(handles)
+	if err != nil {
+		return err
+	}
+	return b.Put(handleKey(nick), data)
+}
+
+func (s site) handlesFor(nick string) (map[string]string, error) {
+	var handles map[string]string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		handles, err = getHandles(tx, nick)
+		return err
+	})
+	return handles, err
+}
+
+// nick's handle on service, or "" if we don't know it
+func (s site) handleFor(nick, service string) string {
+	handles, err := s.handlesFor(nick)
+	if err != nil {
+		log.Println("couldn't look up handles for", nick, err)
+		return ""
+	}
+	return handles[service]
+}
+
+// an empty handle removes it
+func (s *site) setHandle(nick, service, handle string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		handles, err := getHandles(tx, nick)
+		if err != nil {
+			return err
+		}
+		if handle == "" {
+			delete(handles, service)
+		} else {
+			handles[service] = handle
+		}
+		return putHandles(tx, nick, handles)
+	})
+}
+
+var handleFileImported = []byte("handle file imported")
+
+// copy the twitter handles from the old nick,handle CSV file, once.
+// after that, .handle is the only way to change them, so a handle
+// someone removes doesn't come back. anyone who already has one keeps
+// it
+func (s *site) importHandleFile(path string) (int, error) {
+	done := false
+	s.db.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket([]byte("meta")).Get(handleFileImported) != nil
+		return nil
+	})
+	if done {
+		return 0, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	imported := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				return tx.Bucket([]byte("meta")).Put(handleFileImported, []byte(time.Now().Format(time.RFC3339)))
+			}
+			if err != nil {
+				return err
+			}
+			if len(record) != 2 {
+				continue
+			}
+			nick := strings.TrimSpace(record[0])
+			handle, err := cleanHandle("twitter", strings.TrimSpace(record[1]))
+			if nick == "" || err != nil {
+				log.Println("skipping handle file line:", strings.Join(record, ","))
+				continue
+			}
+			handles, err := getHandles(tx, nick)
+			if err != nil {
+				return err
+			}
+			if handles["twitter"] != "" {
+				continue
+			}
+			handles["twitter"] = handle
+			if err := putHandles(tx, nick, handles); err != nil {
+				return err
+			}
+			imported++
+		}
+	})
+	return imported, err
+}
+
+// .handle set/remove/show
+func (cl *channelLogger) handleCommand(c *commandContext) {
+	nick := normalizeNick(c.line.Nick)
+	switch {
+	case len(c.args) == 3 && c.args[0] == "set":
+		service := strings.ToLower(c.args[1])
+		handle, err := cleanHandle(service, c.args[2])
+		if err != nil {
+			c.reply(fmt.Sprintf("couldn't set your %s handle: %s", service, err))
+			return
+		}
+		// otherwise anyone could borrow an absent nick and change
+		// who gets credited
+		cl.whenPermitted(c, identified, func() {
+			if err := cl.site.setHandle(nick, service, handle); err != nil {
+				c.fail(err)
+				return
+			}
+			c.reply(fmt.Sprintf("ok, you're %s on %s", handle, service))
+		})
+	case len(c.args) == 2 && c.args[0] == "remove":
+		service := strings.ToLower(c.args[1])
+		cl.whenPermitted(c, identified, func() {
+			if err := cl.site.setHandle(nick, service, ""); err != nil {
+				c.fail(err)
+				return
+			}
+			c.reply(fmt.Sprintf("ok, forgot your %s handle", service))
+		})
+	case len(c.args) <= 2 && c.args[0] == "show":
+		who := nick
+		if len(c.args) == 2 {
+			who = normalizeNick(c.args[1])
+		}
+		handles, err := cl.site.handlesFor(who)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		// email addresses are for sending mentions, not for handing
+		// out to whoever asks
+		if !strings.EqualFold(who, nick) {
+			delete(handles, "email")
+		}
+		if len(handles) == 0 {
+			c.reply(fmt.Sprintf("I don't know any handles for %s", who))
+			return
+		}
+		parts := []string{}
+		for service, handle := range handles {
+			parts = append(parts, service+": "+handle)
+		}
+		sort.Strings(parts)
+		c.reply(who + " is " + strings.Join(parts, ", "))
+	default:
+		c.replySyntax()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_cleanHandle(t *testing.T) {
+	cases := []struct {
+		service, handle, want string
+		ok                    bool
+	}{
+		{"twitter", "@thraxil", "thraxil", true},
+		{"twitter", "thraxil", "thraxil", true},
+		{"twitter", "way_too_long_for_twitter", "", false},
+		{"mastodon", "@anders@mastodon.social", "@anders@mastodon.social", true},
+		{"mastodon", "anders@mastodon.social", "@anders@mastodon.social", true},
+		{"mastodon", "anders", "", false},
+		{"github", "thraxil", "thraxil", true},
+		{"github", "-thraxil", "", false},
+		{"email", "anders@example.com", "anders@example.com", true},
+		{"email", "Anders <anders@example.com>", "", false},
+		{"myspace", "tom", "", false},
+	}
+	for _, c := range cases {
+		got, err := cleanHandle(c.service, c.handle)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("%s %s: got %q, %v", c.service, c.handle, got, err)
+		}
+	}
+}
+
+func Test_handleCommand(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	cl := s.channelLogger
+	now := time.Now()
+	identified := func(nick, account string) {
+		expectLine(t, lines, "WHOIS "+nick)
+		s.ops.Handle(conn, whoisReply("330", nick, account, "is logged in as"))
+	}
+
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".handle show", now))
+	expectLine(t, lines, "PRIVMSG alice :I don't know any handles for alice")
+	cl.dispatch(conn, "#one", testLine("alice_", "#one", ".handle set twitter @alice", now))
+	identified("alice_", "alice")
+	expectLine(t, lines, "PRIVMSG alice_ :ok, you're alice on twitter")
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle set GitHub alice-dev", now))
+	identified("alice", "alice")
+	expectLine(t, lines, "PRIVMSG alice :ok, you're alice-dev on github")
+	// not identified, or identified as someone else
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle set twitter mallory", now))
+	expectLine(t, lines, "WHOIS alice")
+	s.ops.Handle(conn, whoisReply("318", "alice", "End of /WHOIS list."))
+	expectLine(t, lines, "PRIVMSG alice :you need to identify with NickServ first")
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle remove twitter", now))
+	identified("alice", "mallory")
+	expectLine(t, lines, "PRIVMSG alice :you need to identify with NickServ first")
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle set mastodon nope", now))
+	expectLine(t, lines, "PRIVMSG alice :couldn't set your mastodon handle: mastodon handles look like")
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle set twitter", now))
+	expectLine(t, lines, "PRIVMSG alice :syntax: .handle set service handle")
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle set email alice@example.com", now))
+	identified("alice", "alice")
+	expectLine(t, lines, "PRIVMSG alice :ok, you're alice@example.com on email")
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".handle show Alice", now))
+	expectLine(t, lines, "PRIVMSG bob :Alice is github: alice-dev, twitter: alice")
+	// only alice gets to see her email address
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle show", now))
+	expectLine(t, lines, "PRIVMSG alice :alice is email: alice@example.com, github: alice-dev, twitter: alice")
+
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".handle remove github", now))
+	identified("alice", "alice")
+	expectLine(t, lines, "PRIVMSG alice :ok, forgot your github handle")
+	cl.wait()
+	if h := s.handleFor("ALICE", "twitter"); h != "alice" {
+		t.Error(h)
+	}
+	if h := s.handleFor("alice", "github"); h != "" {
+		t.Error(h)
+	}
+}
+
+func Test_importHandleFile(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "handles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handles.csv")
+	ioutil.WriteFile(path, []byte("alice,alicetweets\n\n bob , @bobtweets\ncarol\nmallory,not a handle\n"), 0600)
+
+	// alice has already set her own
+	if err := s.setHandle("alice", "twitter", "realalice"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.importHandleFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Error(n)
+	}
+	if h := s.handleFor("alice", "twitter"); h != "realalice" {
+		t.Error(h)
+	}
+	if h := s.handleFor("bob", "twitter"); h != "bobtweets" {
+		t.Error(h)
+	}
+	if h := s.handleFor("mallory", "twitter"); h != "" {
+		t.Error(h)
+	}
+	// it only happens once, so removing a handle sticks
+	if err := s.setHandle("bob", "twitter", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.importHandleFile(path); err != nil || n != 0 {
+		t.Error(n, err)
+	}
+	if h := s.handleFor("bob", "twitter"); h != "" {
+		t.Error(h)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// how many links the links page and feed show at a time
+const linksPerPage = 100
+
+// which links someone wants to see. the zero value matches
+// everything
+type linkFilter struct {
+	Nick   string
+	Domain string
+	// Since is inclusive, Until isn't
+	Since time.Time
+	Until time.Time
+}
+
+// the filter from ?nick=, ?domain=, ?from= and ?to=. dates are
+// YYYY-MM-DD, and to includes the whole day
+func parseLinkFilter(r *http.Request) (linkFilter, error) {
+	f := linkFilter{
+		Nick:   normalizeNick(strings.TrimSpace(r.FormValue("nick"))),
+		Domain: strings.ToLower(strings.TrimPrefix(strings.TrimSpace(r.FormValue("domain")), "www.")),
+	}
+	if v := r.FormValue("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return f, fmt.Errorf("bad from date: %s", v)
+		}
+		f.Since = t
+	}
+	if v := r.FormValue("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return f, fmt.Errorf("bad to date: %s", v)
+		}
+		f.Until = t.AddDate(0, 0, 1)
+	}
+	return f, nil
+}
+
+// the filter as query parameters, for links to other pages of
+// the same thing
+func (f linkFilter) query() url.Values {
+	q := url.Values{}
+	if f.Nick != "" {
+		q.Set("nick", f.Nick)
+	}
+	if f.Domain != "" {
+		q.Set("domain", f.Domain)
+	}
+	if !f.Since.IsZero() {
+		q.Set("from", f.Since.Format("2006-01-02"))
+	}
+	if !f.Until.IsZero() {
+		q.Set("to", f.Until.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	return q
+}
+
+// a little description for page titles, eg "by alice from example.com"
+func (f linkFilter) String() string {
+	parts := []string{}
+	if f.Nick != "" {
+		parts = append(parts, "by "+f.Nick)
+	}
+	if f.Domain != "" {
+		parts = append(parts, "from "+f.Domain)
+	}
+	if !f.Since.IsZero() {
+		parts = append(parts, "since "+f.Since.Format("2006-01-02"))
+	}
+	if !f.Until.IsZero() {
+		parts = append(parts, "until "+f.Until.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	return strings.Join(parts, " ")
+}
+
+func linkDomain(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+}
+
+func (f linkFilter) matches(le linkEntry) bool {
+	if f.Nick != "" && normalizeNick(le.Nick) != f.Nick {
+		return false
+	}
+	if f.Domain != "" {
+		d := linkDomain(le.URL)
+		if d != f.Domain && !strings.HasSuffix(d, "."+f.Domain) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && le.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !le.Timestamp.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// up to limit links that match the filter and are older than before
+// (a link key), newest first. an empty before starts from the newest.
+// next is the key to pass in for the page after this one, or empty if
+// there isn't one
+func (s site) links(f linkFilter, before string, limit int) ([]linkEntry, string, error) {
+	links := []linkEntry{}
+	next := ""
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("links")).Cursor()
+		var k, v []byte
+		if before == "" {
+			k, v = c.Last()
+		} else {
+			// Seek lands on before, or the first key after it, so
+			// the one we want is just before that. if there's
+			// nothing after it, everything's older
+			if k, _ = c.Seek([]byte(before)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil; k, v = c.Prev() {
+			var le linkEntry
+			if err := json.Unmarshal(v, &le); err != nil {
+				return err
+			}
+			if !f.Since.IsZero() && le.Timestamp.Before(f.Since) {
+				// they're only getting older from here
+				return nil
+			}
+			if !f.matches(le) {
+				continue
+			}
+			if len(links) == limit {
+				next = links[len(links)-1].Key
+				return nil
+			}
+			links = append(links, le)
+		}
+		return nil
+	})
+	return links, next, err
+}
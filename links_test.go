@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+func saveTestLinks(t *testing.T, s *site) time.Time {
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	ts = ts.Local()
+	links := []struct{ nick, url string }{
+		{"alice", "http://www.example.com/one"},
+		{"bob", "https://blog.example.com/two"},
+		{"alice_", "http://other.org/three"},
+		{"carol", "http://notexample.com/four"},
+		{"alice", "http://example.com/five"},
+	}
+	for i, l := range links {
+		// a day apart
+		line := testLine(l.nick, "#one", "", ts.AddDate(0, 0, i))
+		if err := s.saveLink("#one", line, l.url, fmt.Sprintf("link %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ts
+}
+
+func titles(links []linkEntry) string {
+	t := []string{}
+	for _, l := range links {
+		t = append(t, l.Title)
+	}
+	return strings.Join(t, ",")
+}
+
+func Test_linkFilter(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	start := saveTestLinks(t, s)
+
+	cases := []struct {
+		f        linkFilter
+		expected string
+	}{
+		{linkFilter{}, "link 4,link 3,link 2,link 1,link 0"},
+		{linkFilter{Nick: "alice"}, "link 4,link 2,link 0"},
+		{linkFilter{Domain: "example.com"}, "link 4,link 1,link 0"},
+		{linkFilter{Domain: "other.org"}, "link 2"},
+		{linkFilter{Since: start.AddDate(0, 0, 1), Until: start.AddDate(0, 0, 3)}, "link 2,link 1"},
+		{linkFilter{Nick: "alice", Since: start.AddDate(0, 0, 1)}, "link 4,link 2"},
+	}
+	for _, c := range cases {
+		links, next, err := s.links(c.f, "", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if titles(links) != c.expected || next != "" {
+			t.Errorf("%+v: got %s, expected %s", c.f, titles(links), c.expected)
+		}
+	}
+
+	// two at a time
+	f := linkFilter{Nick: "alice"}
+	links, next, _ := s.links(f, "", 2)
+	if titles(links) != "link 4,link 2" || next != links[1].Key {
+		t.Fatal(titles(links), next)
+	}
+	links, next, _ = s.links(f, next, 2)
+	if titles(links) != "link 0" || next != "" {
+		t.Error(titles(links), next)
+	}
+}
+
+func Test_parseLinkFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/links/?nick=alice_&domain=www.Example.com&from=2015-02-01&to=2015-02-28", nil)
+	f, err := parseLinkFilter(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Nick != "alice" || f.Domain != "example.com" {
+		t.Error(f)
+	}
+	if f.Until.Format("2006-01-02") != "2015-03-01" {
+		t.Error("to should include the whole day", f.Until)
+	}
+	if q := f.query().Encode(); q != "domain=example.com&from=2015-02-01&nick=alice&to=2015-02-28" {
+		t.Error(q)
+	}
+	if f.String() != "by alice from example.com since 2015-02-01 until 2015-02-28" {
+		t.Error(f.String())
+	}
+
+	r = httptest.NewRequest("GET", "/links/?from=yesterday", nil)
+	if _, err := parseLinkFilter(r); err == nil {
+		t.Error("bad dates should be an error")
+	}
+}
+
+func Test_linksPages(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	saveTestLinks(t, s)
+
+	w := httptest.NewRecorder()
+	linksHandler(w, httptest.NewRequest("GET", "/links/by/alice/?limit=2", nil), s)
+	body := w.Body.String()
+	if !strings.Contains(body, "link 4") || !strings.Contains(body, "link 2") || strings.Contains(body, "link 1") {
+		t.Error(body)
+	}
+	if !strings.Contains(body, `href="/links/feed/?nick=alice"`) || !strings.Contains(body, `href="/links/by/alice/?before=`) {
+		t.Error("expected feed and older links", body)
+	}
+
+	w = httptest.NewRecorder()
+	linksFeedHandler(w, httptest.NewRequest("GET", "/links/feed/?domain=other.org", nil), s)
+	body = w.Body.String()
+	if !strings.Contains(body, "http://other.org/three") || strings.Contains(body, "example.com/five") {
+		t.Error(body)
+	}
+
+	w = httptest.NewRecorder()
+	linksHandler(w, httptest.NewRequest("GET", "/links/?to=tomorrow", nil), s)
+	if w.Code != 400 {
+		t.Error(w.Code)
+	}
+}
+
+func Test_searchLinks(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	s.channelLogger.logLine("#one", testLine("alice", "#one", "anyone know about postgres vacuuming?", ts))
+	s.saveLink("#one", testLine("bob", "#one", "", ts.Add(time.Minute)),
+		"http://example.com/vacuum", "All about postgres vacuuming")
+
+	result, links, err := s.searchLinks("postgres", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 1 || len(links) != 1 || links[0].URL != "http://example.com/vacuum" {
+		t.Error(result.Total, links)
+	}
+	result, lines, err := s.searchLines("postgres", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 1 || len(lines) != 1 || lines[0].Nick != "alice" {
+		t.Error("links shouldn't show up with the lines", result.Total, lines)
+	}
+	if _, links, _ := s.searchLinks("domain:example.com", 10, 0); len(links) != 1 {
+		t.Error(links)
+	}
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search/?q=postgres&type=links", nil), s)
+	if !strings.Contains(w.Body.String(), `<a href="http://example.com/vacuum">All about postgres vacuuming</a>`) {
+		t.Error(w.Body.String())
+	}
+}
+
+func Test_backfillLinkIndex(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	saveTestLinks(t, s)
+
+	// start again with an empty index, like we would have before
+	// links were indexed
+	indexMapping, _ := buildIndexMapping()
+	s.index, _ = bleve.NewMemOnly(indexMapping)
+	if err := s.backfillLinkIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.index.DocCount(); n != 5 {
+		t.Error(n)
+	}
+	if _, links, _ := s.searchLinks("other", 10, 0); len(links) != 1 || links[0].Title != "link 2" {
+		t.Error(links)
+	}
+
+	// it only happens once
+	s.index, _ = bleve.NewMemOnly(indexMapping)
+	if err := s.backfillLinkIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.index.DocCount(); n != 0 {
+		t.Error(n)
+	}
+}
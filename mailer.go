@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// mailer emails people when they're mentioned while they're
+// offline. mentions are collected into a digest per address, and
+// each address gets at most one email per interval.
+type mailer struct {
+	addr     string
+	auth     smtp.Auth
+	from     string
+	baseURL  string
+	interval time.Duration
+	// how long to wait for more mentions before sending, when we
+	// haven't emailed someone recently
+	gather time.Duration
+
+	mu        sync.Mutex
+	queued    map[string][]mention
+	scheduled map[string]bool
+	lastSent  map[string]time.Time
+}
+
+func newMailer(host string, port int, user, pass, from, baseURL string, interval time.Duration) *mailer {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, pass, host)
+	}
+	return &mailer{
+		addr:      fmt.Sprintf("%s:%d", host, port),
+		auth:      auth,
+		from:      from,
+		baseURL:   baseURL,
+		interval:  interval,
+		gather:    time.Minute,
+		queued:    map[string][]mention{},
+		scheduled: map[string]bool{},
+		lastSent:  map[string]time.Time{},
+	}
+}
+
+// add a mention to the next digest for an address
+func (m *mailer) queue(address string, mn mention) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued[address] = append(m.queued[address], mn)
+	if m.scheduled[address] {
+		return
+	}
+	m.scheduled[address] = true
+	wait := m.gather
+	if next := m.lastSent[address].Add(m.interval); time.Until(next) > wait {
+		wait = time.Until(next)
+	}
+	time.AfterFunc(wait, func() { m.flush(address) })
+}
+
+func (m *mailer) flush(address string) {
+	m.mu.Lock()
+	mentions := m.queued[address]
+	delete(m.queued, address)
+	delete(m.scheduled, address)
+	m.lastSent[address] = time.Now()
+	m.mu.Unlock()
+
+	if len(mentions) == 0 {
+		return
+	}
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{address}, m.digest(address, mentions))
+	if err != nil {
+		log.Println("couldn't send email to", address)
+		log.Println(err)
+		return
+	}
+	log.Println("emailed", len(mentions), "mentions to", address)
+}
+
+// send everything that's waiting right away, rather than leaving it
+// for timers that won't go off once we've shut down
+func (m *mailer) flushAll() {
+	m.mu.Lock()
+	addresses := []string{}
+	for address := range m.queued {
+		addresses = append(addresses, address)
+	}
+	m.mu.Unlock()
+	for _, address := range addresses {
+		m.flush(address)
+	}
+}
+
+func (m *mailer) digest(address string, mentions []mention) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", address)
+	fmt.Fprintf(&b, "Subject: frontdesk: %d messages while you were out\r\n", len(mentions))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "You were mentioned on IRC while you were away:\r\n")
+	for _, mn := range mentions {
+		fmt.Fprintf(&b, "\r\n[%s %s] <%s> %s\r\n", mn.Channel,
+			mn.Timestamp.Format("2006-01-02 15:04"), mn.Nick, mn.Text)
+		if mn.Key != "" {
+			fmt.Fprintf(&b, "%s%s\r\n", m.baseURL, mn.Permalink())
+		}
+	}
+	return b.Bytes()
+}
+
+// .email set/off, in the channel or a private message
+func (cl *channelLogger) emailCommand(c *commandContext) {
+	nick := normalizeNick(c.line.Nick)
+	switch {
+	case len(c.args) == 2 && c.args[0] == "set":
+		err := cl.site.setEmail(nick, c.args[1])
+		if err != nil {
+			c.reply(fmt.Sprintf("couldn't set your email: %s", err))
+			return
+		}
+		c.reply(fmt.Sprintf("ok, I'll email %s when you're mentioned while you're away", c.args[1]))
+	case len(c.args) == 1 && c.args[0] == "off":
+		if err := cl.site.setEmail(nick, ""); err != nil {
+			c.fail(err)
+			return
+		}
+		c.reply("ok, no more emails")
+	default:
+		c.replySyntax()
+	}
+}
+
+// mentions go to the email handle (see handles.go). an empty address
+// turns email off
+func (s *site) setEmail(nick, address string) error {
+	if address != "" {
+		var err error
+		if address, err = cleanHandle("email", address); err != nil {
+			return err
+		}
+	}
+	return s.setHandle(nick, "email", address)
+}
+
+func (s site) emailFor(nick string) (string, error) {
+	handles, err := s.handlesFor(nick)
+	return handles["email"], err
+}
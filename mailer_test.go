@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// just enough of an SMTP server to accept mail. each message's DATA
+// is sent down the returned channel
+func smtpSink(t *testing.T) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+				reply("220 localhost ESMTP sink")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(strings.TrimSpace(l))
+					switch {
+					case strings.HasPrefix(cmd, "DATA"):
+						reply("354 go ahead")
+						var data []string
+						for {
+							l, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							l = strings.TrimRight(l, "\r\n")
+							if l == "." {
+								break
+							}
+							data = append(data, l)
+						}
+						messages <- strings.Join(data, "\n")
+						reply("250 ok")
+					case strings.HasPrefix(cmd, "QUIT"):
+						reply("221 bye")
+						return
+					default:
+						reply("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+	return ln, messages
+}
+
+func Test_mailerDigest(t *testing.T) {
+	ln, messages := smtpSink(t)
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	m := newMailer(host, p, "", "", "frontdesk@example.com", "http://example.com", 200*time.Millisecond)
+	m.gather = 50 * time.Millisecond
+
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	m.queue("alice@example.com", newMention("#one", testLine("bob", "#one", "alice: one", ts)))
+	m.queue("alice@example.com", newMention("#one", testLine("bob", "#one", "alice: two", ts.Add(time.Second))))
+
+	var msg string
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email")
+	}
+	for _, expected := range []string{
+		"To: alice@example.com",
+		"Subject: frontdesk: 2 messages while you were out",
+		"<bob> alice: one",
+		"<bob> alice: two",
+		"http://example.com/logs/one/2015/02/15/#2015-02-15T12:04:36.439011141-05:00",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("expected %q in\n%s", expected, msg)
+		}
+	}
+
+	// another one right away has to wait for the interval
+	start := time.Now()
+	m.queue("alice@example.com", newMention("#one", testLine("bob", "#one", "alice: three", ts)))
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("sent too soon")
+	}
+	if !strings.Contains(msg, "Subject: frontdesk: 1 messages") {
+		t.Error(msg)
+	}
+}
+
+func Test_mailerFlushAll(t *testing.T) {
+	ln, messages := smtpSink(t)
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	// nothing would go out for an hour, but we're shutting down
+	m := newMailer(host, p, "", "", "frontdesk@example.com", "http://example.com", time.Hour)
+	m.gather = time.Hour
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	m.queue("alice@example.com", newMention("#one", testLine("bob", "#one", "alice: ping", ts)))
+	m.queue("carol@example.com", newMention("#one", testLine("bob", "#one", "carol: ping", ts)))
+	m.flushAll()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			if !strings.Contains(msg, ": ping") {
+				t.Error(msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no email")
+		}
+	}
+}
+
+func Test_emailCommand(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	now := time.Now()
+
+	identified := func(nick, account string) {
+		expectLine(t, lines, "WHOIS "+nick)
+		s.ops.Handle(conn, whoisReply("330", nick, account, "is logged in as"))
+	}
+
+	s.channelLogger.dispatch(conn, "", testLine("alice_", "frontdesk", ".email set not-an-address", now))
+	identified("alice_", "alice")
+	expectLine(t, lines, "PRIVMSG alice_ :couldn't set your email")
+	s.channelLogger.dispatch(conn, "", testLine("alice_", "frontdesk", ".email set alice@example.com", now))
+	identified("alice_", "alice")
+	expectLine(t, lines, "PRIVMSG alice_ :ok, I'll email alice@example.com")
+	if e, _ := s.emailFor("alice"); e != "alice@example.com" {
+		t.Error(e)
+	}
+	// it's the same thing as the email handle
+	if h := s.handleFor("alice", "email"); h != "alice@example.com" {
+		t.Error(h)
+	}
+
+	// someone else using alice's nick can't change it
+	s.channelLogger.dispatch(conn, "", testLine("alice", "frontdesk", ".email set mallory@example.com", now))
+	identified("alice", "mallory")
+	expectLine(t, lines, "PRIVMSG alice :you need to identify with NickServ first")
+
+	s.channelLogger.dispatch(conn, "", testLine("alice", "frontdesk", ".email off", now))
+	identified("alice", "alice")
+	expectLine(t, lines, "PRIVMSG alice :ok, no more emails")
+	if e, _ := s.emailFor("alice"); e != "" {
+		t.Error(e)
+	}
+}
+
+func Test_migrateEmails(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucket([]byte("emails"))
+		b.Put([]byte("alice"), []byte("alice@example.com"))
+		b.Put([]byte("bob"), []byte("old@example.com"))
+		return nil
+	})
+	s.setHandle("bob", "email", "new@example.com")
+	s.migrateEmails()
+	if e, _ := s.emailFor("alice"); e != "alice@example.com" {
+		t.Error(e)
+	}
+	if e, _ := s.emailFor("bob"); e != "new@example.com" {
+		t.Error(e)
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("emails")) != nil {
+			t.Error("emails bucket should be gone")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// counters for /metrics. they're global, like backoff, so anything
+// can bump them without needing the site handed to it
+
+var (
+	linesLogged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "frontdesk_lines_logged_total",
+		Help: "Lines written to the db (and the index, if they're searchable).",
+	}, []string{"channel"})
+	linksSaved = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "frontdesk_links_saved_total",
+		Help: "Links saved, with .url or picked up from the channel.",
+	})
+	mentionsStored = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "frontdesk_mentions_stored_total",
+		Help: "Messages held for someone who wasn't around.",
+	})
+	mentionsDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "frontdesk_mentions_delivered_total",
+		Help: "Held messages sent to someone when they came back.",
+	})
+	tweets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "frontdesk_tweets_total",
+		Help: "Attempts to tweet (links and .tweet), by whether they worked.",
+	}, []string{"result"})
+	linksPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "frontdesk_links_published_total",
+		Help: "Links sent on to twitter, mastodon, webhooks etc., by whether it worked.",
+	}, []string{"publisher", "result"})
+	linksShortened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "frontdesk_links_shortened_total",
+		Help: "Attempts to shorten links, by shortener and whether it worked.",
+	}, []string{"shortener", "result"})
+	reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "frontdesk_reconnects_total",
+		Help: "Times we've been disconnected from IRC and tried to get back on.",
+	})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "frontdesk_http_request_duration_seconds",
+		Help:    "How long the web handlers take.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+)
+
+// everything we report, including a few gauges that have to look
+// at the site to get their values
+func newMetricsRegistry(s *site) *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		linesLogged, linksSaved, mentionsStored, mentionsDelivered,
+		tweets, linksPublished, linksShortened, reconnects, httpDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "frontdesk_backoff",
+			Help: "Failed IRC connection attempts since we were last connected.",
+		}, func() float64 { return float64(backoff) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "frontdesk_db_size_bytes",
+			Help: "Size of the bolt db.",
+		}, func() float64 {
+			var size int64
+			s.db.View(func(tx *bolt.Tx) error {
+				size = tx.Size()
+				return nil
+			})
+			return float64(size)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "frontdesk_index_docs",
+			Help:        "Documents in the search index, by kind.",
+			ConstLabels: prometheus.Labels{"kind": "lines"},
+		}, func() float64 {
+			n, _, _ := s.indexCounts()
+			return float64(n)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "frontdesk_index_docs",
+			Help:        "Documents in the search index, by kind.",
+			ConstLabels: prometheus.Labels{"kind": "links"},
+		}, func() float64 {
+			_, n, _ := s.indexCounts()
+			return float64(n)
+		}),
+	)
+	return r
+}
+
+func metricsHandler(s *site) http.Handler {
+	return promhttp.HandlerFor(newMetricsRegistry(s), promhttp.HandlerOpts{})
+}
+
+// time a web handler, under the given name
+func observe(name string, start time.Time) {
+	httpDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
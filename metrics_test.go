@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_metrics(t *testing.T) {
+	s, cleanup := newTestSite(t, "#metrics")
+	defer cleanup()
+
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	s.channelLogger.logLine("#metrics", testLine("alice", "#metrics", "count me", ts))
+	if err := s.storeLink(newLinkEntry("#metrics", testLine("alice", "#metrics", ".url http://example.com/", ts), "http://example.com/", "a link")); err != nil {
+		t.Fatal(err)
+	}
+	h := makeHandler("index", indexHandler, s)
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	w := httptest.NewRecorder()
+	metricsHandler(s).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`frontdesk_lines_logged_total{channel="#metrics"} 1`,
+		`frontdesk_http_request_duration_seconds_count{handler="index"}`,
+		`frontdesk_index_docs{kind="lines"} 1`,
+		`frontdesk_index_docs{kind="links"} 1`,
+		"frontdesk_db_size_bytes",
+		"frontdesk_backoff 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Error("missing", want)
+		}
+	}
+}
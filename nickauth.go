@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// nickAuth keeps track of whether we've managed to identify our
+// nick. SASL happens during registration (goirc takes care of the
+// actual exchange), and if that isn't configured or didn't work, we
+// fall back to sending NickServ an IDENTIFY once we're connected.
+type nickAuth struct {
+	nick         string
+	saslMech     string
+	nickservPass string
+
+	mu         sync.Mutex
+	identified bool
+	rejected   bool
+	reason     string
+}
+
+func newNickAuth(nick, saslMech, nickservPass string) *nickAuth {
+	return &nickAuth{nick: nick, saslMech: saslMech, nickservPass: nickservPass}
+}
+
+// whether there's any authentication to check up on
+func (na *nickAuth) configured() bool {
+	return na.saslMech != "" || na.nickservPass != ""
+}
+
+// returns true and the reason if the network turned us down
+func (na *nickAuth) failed() (bool, string) {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	return na.rejected, na.reason
+}
+
+func (na *nickAuth) isIdentified() bool {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	return na.identified
+}
+
+// called once we're connected
+func (na *nickAuth) identify(conn *irc.Conn) {
+	if na.isIdentified() || na.nickservPass == "" {
+		return
+	}
+	log.Println("identifying to NickServ as", na.nick)
+	conn.Privmsg("NickServ", "IDENTIFY "+na.nick+" "+na.nickservPass)
+}
+
+// called on disconnect. we'll have to do it all again
+func (na *nickAuth) reset() {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	na.identified = false
+	na.rejected = false
+	na.reason = ""
+}
+
+func (na *nickAuth) succeed(how string) {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	log.Println("identified via", how)
+	na.identified = true
+	na.rejected = false
+	na.reason = ""
+}
+
+func (na *nickAuth) reject(reason string) {
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	log.Println("authentication rejected:", reason)
+	na.rejected = true
+	na.reason = reason
+}
+
+// called for the SASL numerics and for NOTICEs
+func (na *nickAuth) Handle(conn *irc.Conn, line *irc.Line) {
+	switch line.Cmd {
+	case "900", "903":
+		// RPL_LOGGEDIN, RPL_SASLSUCCESS
+		na.succeed("SASL " + strings.ToUpper(na.saslMech))
+	case "902", "904", "905", "906":
+		// ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+		na.reject("SASL " + line.Cmd + ": " + line.Text())
+	case "NOTICE":
+		if na.nickservPass == "" || !strings.EqualFold(line.Nick, "NickServ") {
+			return
+		}
+		text := strings.ToLower(line.Text())
+		if strings.Contains(text, "you are now identified") ||
+			strings.Contains(text, "password accepted") {
+			na.succeed("NickServ")
+			return
+		}
+		if strings.Contains(text, "invalid password") ||
+			strings.Contains(text, "password incorrect") ||
+			strings.Contains(text, "isn't registered") ||
+			strings.Contains(text, "is not registered") {
+			na.reject("NickServ: " + line.Text())
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func Test_nickAuthSASL(t *testing.T) {
+	na := newNickAuth("frontdesk", "PLAIN", "")
+	if !na.configured() {
+		t.Error("should be configured")
+	}
+	na.Handle(nil, &irc.Line{Cmd: "904", Args: []string{"frontdesk", "SASL authentication failed"}})
+	if rejected, reason := na.failed(); !rejected || reason != "SASL 904: SASL authentication failed" {
+		t.Error("should have been rejected", reason)
+	}
+	na.reset()
+	if rejected, _ := na.failed(); rejected {
+		t.Error("reset should clear the rejection")
+	}
+	na.Handle(nil, &irc.Line{Cmd: "903", Args: []string{"frontdesk", "SASL authentication successful"}})
+	if !na.isIdentified() {
+		t.Error("should be identified")
+	}
+}
+
+func Test_nickAuthNickServ(t *testing.T) {
+	na := newNickAuth("frontdesk", "", "sekrit")
+
+	// notices from anyone else are ignored
+	na.Handle(nil, &irc.Line{Cmd: "NOTICE", Nick: "mallory", Args: []string{"frontdesk", "Invalid password for frontdesk."}})
+	if rejected, _ := na.failed(); rejected {
+		t.Error("should only listen to NickServ")
+	}
+
+	na.Handle(nil, &irc.Line{Cmd: "NOTICE", Nick: "NickServ", Args: []string{"frontdesk", "Invalid password for frontdesk."}})
+	if rejected, _ := na.failed(); !rejected {
+		t.Error("should have been rejected")
+	}
+	na.Handle(nil, &irc.Line{Cmd: "NOTICE", Nick: "NickServ", Args: []string{"frontdesk", "You are now identified for frontdesk."}})
+	if rejected, _ := na.failed(); rejected || !na.isIdentified() {
+		t.Error("should be identified")
+	}
+}
+
+func Test_nickAuthIdentify(t *testing.T) {
+	ln, lines := fakeIRCServer(t)
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	ic, _ := newIRCConfig(config{Nick: "frontdesk", Server: host, IRCPort: p})
+	c := irc.Client(ic)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	na := newNickAuth("frontdesk", "", "sekrit")
+	na.identify(c)
+	if l := expectLine(t, lines, "PRIVMSG NickServ"); l != "PRIVMSG NickServ :IDENTIFY frontdesk sekrit" {
+		t.Error(l)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	irc "github.com/fluffle/goirc/client"
+)
+
+// ops keeps a whitelist of nicks that frontdesk gives channel
+// operator status to when they join, as long as they've identified
+// with NickServ. the admins (from the config) are always on it, and
+// they're the only ones who can change it.
+//
+// the "ops" bucket maps each (lowercased) nick on the list to an
+// opEntry, and every mode change we make goes in the "oplog" bucket,
+// keyed by time.
+type ops struct {
+	site   *site
+	admins []string
+
+	// things waiting on a WHOIS to tell us which account a nick is
+	// logged in as
+	mu      sync.Mutex
+	pending map[string]*pendingWhois
+}
+
+type pendingWhois struct {
+	sent      time.Time
+	callbacks []func(account string)
+}
+
+// how long to wait for a WHOIS reply before asking again. replies can
+// get lost, eg if we're disconnected in the middle of one
+var whoisTimeout = 30 * time.Second
+
+type opEntry struct {
+	AddedBy string    `json:"added_by"`
+	Added   time.Time `json:"added"`
+}
+
+type opLogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Channel   string    `json:"channel"`
+	Mode      string    `json:"mode"`
+	Nick      string    `json:"nick"`
+	// the admin who asked for it, or "auto-op"
+	By string `json:"by"`
+}
+
+func (e opLogEntry) String() string {
+	return fmt.Sprintf("%s %s %s in %s (%s)",
+		e.Timestamp.Format("2006-01-02 15:04"), e.Mode, e.Nick, e.Channel, e.By)
+}
+
+func newOps(s *site, admins []string) *ops {
+	return &ops{site: s, admins: admins, pending: map[string]*pendingWhois{}}
+}
+
+func opKey(nick string) []byte {
+	return []byte(strings.ToLower(normalizeNick(nick)))
+}
+
+func (o *ops) isAdmin(nick string) bool {
+	for _, a := range o.admins {
+		if strings.EqualFold(normalizeNick(nick), a) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether this nick should be opped
+func (o *ops) isOp(nick string) (bool, error) {
+	if o.isAdmin(nick) {
+		return true, nil
+	}
+	found := false
+	err := o.site.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte("ops")).Get(opKey(nick)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// everyone on the list, admins included
+func (o *ops) list() ([]string, error) {
+	nicks := append([]string{}, o.admins...)
+	err := o.site.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("ops")).ForEach(func(k, v []byte) error {
+			if !o.isAdmin(string(k)) {
+				nicks = append(nicks, string(k))
+			}
+			return nil
+		})
+	})
+	sort.Strings(nicks)
+	return nicks, err
+}
+
+func (o *ops) add(nick, by string) error {
+	on, err := o.isOp(nick)
+	if err != nil {
+		return err
+	}
+	if on {
+		return errors.New("they're already on the list")
+	}
+	data, err := json.Marshal(opEntry{AddedBy: by, Added: time.Now()})
+	if err != nil {
+		return err
+	}
+	return o.site.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("ops")).Put(opKey(nick), data)
+	})
+}
+
+func (o *ops) remove(nick string) error {
+	if o.isAdmin(nick) {
+		return errors.New("admins can only be removed in the config")
+	}
+	on, err := o.isOp(nick)
+	if err != nil {
+		return err
+	}
+	if !on {
+		return errors.New("they aren't on the list")
+	}
+	return o.site.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("ops")).Delete(opKey(nick))
+	})
+}
+
+// ask the server who nick is logged in as, and call f with the
+// account name, or "" if they haven't identified
+func (o *ops) whois(conn *irc.Conn, nick string, f func(account string)) {
+	k := strings.ToLower(nick)
+	o.mu.Lock()
+	p := o.pending[k]
+	if p == nil {
+		p = &pendingWhois{}
+		o.pending[k] = p
+	}
+	p.callbacks = append(p.callbacks, f)
+	// ask if we haven't yet, or if the last answer never came
+	send := p.sent.IsZero() || time.Since(p.sent) > whoisTimeout
+	if send {
+		p.sent = time.Now()
+	}
+	o.mu.Unlock()
+	if send {
+		conn.Whois(nick)
+	}
+}
+
+func (o *ops) resolve(nick, account string) {
+	k := strings.ToLower(nick)
+	o.mu.Lock()
+	p := o.pending[k]
+	delete(o.pending, k)
+	o.mu.Unlock()
+	if p == nil {
+		return
+	}
+	for _, f := range p.callbacks {
+		f(account)
+	}
+}
+
+// forget everything we're waiting on. when we've been disconnected,
+// those replies aren't coming
+func (o *ops) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = map[string]*pendingWhois{}
+}
+
+// change someone's mode in a channel and write it down
+func (o *ops) mode(conn *irc.Conn, channel, mode, nick, by string) error {
+	o.site.outbox.mode(conn, channel, mode, nick)
+	e := opLogEntry{Timestamp: time.Now(), Channel: channel, Mode: mode, Nick: nick, By: by}
+	log.Println("mode change:", e)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return o.site.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("oplog")).Put([]byte(e.Timestamp.Format(time.RFC3339Nano)), data)
+	})
+}
+
+// the last n mode changes we made, oldest first
+func (o *ops) recentChanges(n int) ([]opLogEntry, error) {
+	entries := []opLogEntry{}
+	err := o.site.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("oplog")).Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < n; k, v = c.Prev() {
+			var e opLogEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append([]opLogEntry{e}, entries...)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// op someone in these channels if they're logged in to an account
+// that's on the list
+func (o *ops) opIfIdentified(conn *irc.Conn, nick string, channels []string, by string) {
+	o.whois(conn, nick, func(account string) {
+		on, err := o.isOp(account)
+		if err != nil {
+			log.Println("couldn't check the ops list:", err)
+			return
+		}
+		if account == "" || !on {
+			log.Println(nick, "is on the ops list but isn't identified")
+			return
+		}
+		for _, c := range channels {
+			if err := o.mode(conn, c, "+o", nick, by); err != nil {
+				log.Println("couldn't record mode change:", err)
+			}
+		}
+	})
+}
+
+// called for JOIN and the WHOIS replies
+func (o *ops) Handle(conn *irc.Conn, line *irc.Line) {
+	switch line.Cmd {
+	case "JOIN":
+		channel, ok := o.site.configuredChannel(line.Target())
+		if !ok {
+			return
+		}
+		on, err := o.isOp(line.Nick)
+		if err != nil {
+			log.Println("couldn't check the ops list:", err)
+			return
+		}
+		if !on {
+			return
+		}
+		o.opIfIdentified(conn, line.Nick, []string{channel}, "auto-op")
+	case "330":
+		// RPL_WHOISACCOUNT. args are: our nick, nick, account
+		if len(line.Args) >= 3 {
+			o.resolve(line.Args[1], line.Args[2])
+		}
+	case "307":
+		// RPL_WHOISREGNICK, which some networks send instead
+		if len(line.Args) >= 2 {
+			o.resolve(line.Args[1], line.Args[1])
+		}
+	case "318":
+		// end of WHOIS. if we haven't heard by now, they aren't
+		// logged in
+		if len(line.Args) >= 2 {
+			o.resolve(line.Args[1], "")
+		}
+	}
+}
+
+// .op add/remove/list/log. the dispatcher makes sure it's an
+// identified admin
+func (cl *channelLogger) opCommand(c *commandContext) {
+	o := cl.site.ops
+	switch {
+	case len(c.args) == 1 && c.args[0] == "list":
+		nicks, err := o.list()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.reply("ops: " + strings.Join(nicks, ", "))
+	case len(c.args) == 1 && c.args[0] == "log":
+		changes, err := o.recentChanges(10)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if len(changes) == 0 {
+			c.reply("I haven't changed anyone's mode")
+		}
+		for _, e := range changes {
+			c.reply(e.String())
+		}
+	case len(c.args) == 2 && c.args[0] == "add":
+		nick := normalizeNick(c.args[1])
+		if err := o.add(nick, c.line.Nick); err != nil {
+			c.reply(fmt.Sprintf("couldn't add %s: %s", nick, err))
+			return
+		}
+		c.reply(fmt.Sprintf("ok, I'll op %s when they join", nick))
+		channels, err := cl.site.channelsFor(c.args[1])
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if len(channels) > 0 {
+			o.opIfIdentified(c.conn, c.args[1], channels, c.line.Nick)
+		}
+	case len(c.args) == 2 && c.args[0] == "remove":
+		nick := normalizeNick(c.args[1])
+		if err := o.remove(nick); err != nil {
+			c.reply(fmt.Sprintf("couldn't remove %s: %s", nick, err))
+			return
+		}
+		c.reply(fmt.Sprintf("ok, %s is off the ops list", nick))
+		channels, err := cl.site.channelsFor(c.args[1])
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		for _, ch := range channels {
+			if err := o.mode(c.conn, ch, "-o", c.args[1], c.line.Nick); err != nil {
+				c.fail(err)
+			}
+		}
+	default:
+		c.replySyntax()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func whoisReply(cmd, nick string, args ...string) *irc.Line {
+	return &irc.Line{Cmd: cmd, Args: append([]string{"frontdesk", nick}, args...)}
+}
+
+func Test_autoOp(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.ops = newOps(s, []string{"admin"})
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	now := time.Now()
+	isOp := func(nick string) bool {
+		on, err := s.ops.isOp(nick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return on
+	}
+
+	// only admins get anywhere
+	s.channelLogger.dispatch(conn, "#one", testLine("mallory", "#one", ".op add mallory", now))
+	expectLine(t, lines, "PRIVMSG mallory :sorry, only admins")
+
+	// and they have to have identified
+	s.channelLogger.dispatch(conn, "#one", testLine("admin", "#one", ".op add bob", now))
+	expectLine(t, lines, "WHOIS admin")
+	s.ops.Handle(conn, whoisReply("318", "admin", "End of /WHOIS list."))
+	expectLine(t, lines, "PRIVMSG admin :you need to identify")
+	if isOp("bob") {
+		t.Error("bob shouldn't have been added")
+	}
+
+	s.channelLogger.dispatch(conn, "#one", testLine("admin", "#one", ".op add bob", now))
+	expectLine(t, lines, "WHOIS admin")
+	s.ops.Handle(conn, whoisReply("330", "admin", "admin", "is logged in as"))
+	expectLine(t, lines, "PRIVMSG admin :ok, I'll op bob")
+	if !isOp("bob") || !isOp("Bob_") {
+		t.Error("bob should be on the list")
+	}
+
+	// people who aren't on the list are left alone
+	s.ops.Handle(conn, &irc.Line{Cmd: "JOIN", Nick: "mallory", Args: []string{"#one"}})
+
+	// bob has to be identified too
+	s.ops.Handle(conn, &irc.Line{Cmd: "JOIN", Nick: "bob", Args: []string{"#one"}})
+	expectLine(t, lines, "WHOIS bob")
+	s.ops.Handle(conn, whoisReply("330", "bob", "mallory", "is logged in as"))
+	s.ops.Handle(conn, &irc.Line{Cmd: "JOIN", Nick: "bob", Args: []string{"#one"}})
+	expectLine(t, lines, "WHOIS bob")
+	s.ops.Handle(conn, whoisReply("330", "bob", "bob", "is logged in as"))
+	s.ops.Handle(conn, whoisReply("318", "bob", "End of /WHOIS list."))
+	expectLine(t, lines, "MODE #one +o bob")
+
+	changes, _ := s.ops.recentChanges(10)
+	if len(changes) != 1 {
+		t.Fatal(changes)
+	}
+	if changes[0].Channel != "#one" || changes[0].Mode != "+o" || changes[0].Nick != "bob" || changes[0].By != "auto-op" {
+		t.Error(changes[0])
+	}
+
+	// removing someone who's in the channel deops them
+	s.userLogger.Handle(conn, &irc.Line{Cmd: "JOIN", Nick: "bob", Args: []string{"#one"}, Time: now})
+	s.channelLogger.dispatch(conn, "", testLine("admin", "frontdesk", ".op remove bob", now))
+	expectLine(t, lines, "WHOIS admin")
+	s.ops.Handle(conn, whoisReply("307", "admin", "has identified for this nick"))
+	expectLine(t, lines, "PRIVMSG admin :ok, bob is off the ops list")
+	expectLine(t, lines, "MODE #one -o bob")
+	s.channelLogger.wait()
+	if isOp("bob") {
+		t.Error("bob should be off the list")
+	}
+	if changes, _ := s.ops.recentChanges(10); len(changes) != 2 || changes[1].By != "admin" {
+		t.Error(changes)
+	}
+	if err := s.ops.remove("admin"); err == nil {
+		t.Error("admins shouldn't be removable")
+	}
+}
+
+// a WHOIS reply that never comes shouldn't lock someone out for good
+func Test_lostWhois(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.ops = newOps(s, []string{"admin"})
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	now := time.Now()
+	defer func(d time.Duration) { whoisTimeout = d }(whoisTimeout)
+
+	s.channelLogger.dispatch(conn, "", testLine("admin", "frontdesk", ".op list", now))
+	expectLine(t, lines, "WHOIS admin")
+	s.ops.mu.Lock()
+	sent := s.ops.pending["admin"].sent
+	s.ops.mu.Unlock()
+	// no reply. a second try while we're still waiting doesn't ask again
+	s.channelLogger.dispatch(conn, "", testLine("admin", "frontdesk", ".op list", now))
+	s.ops.mu.Lock()
+	if p := s.ops.pending["admin"]; len(p.callbacks) != 2 || !p.sent.Equal(sent) {
+		t.Error("should still be waiting on the first WHOIS", p)
+	}
+	s.ops.mu.Unlock()
+	// but once it's been too long, it does
+	whoisTimeout = 0
+	s.channelLogger.dispatch(conn, "", testLine("admin", "frontdesk", ".op list", now))
+	expectLine(t, lines, "WHOIS admin")
+	whoisTimeout = time.Hour
+	s.ops.Handle(conn, whoisReply("330", "admin", "admin", "is logged in as"))
+	for i := 0; i < 3; i++ {
+		expectLine(t, lines, "PRIVMSG admin :ops: admin")
+	}
+
+	// and a disconnect forgets whatever we were waiting on
+	s.channelLogger.dispatch(conn, "", testLine("admin", "frontdesk", ".op list", now))
+	expectLine(t, lines, "WHOIS admin")
+	s.ops.reset()
+	s.channelLogger.dispatch(conn, "", testLine("admin", "frontdesk", ".op list", now))
+	expectLine(t, lines, "WHOIS admin")
+	s.ops.Handle(conn, whoisReply("330", "admin", "admin", "is logged in as"))
+	expectLine(t, lines, "PRIVMSG admin :ops: admin")
+	s.channelLogger.wait()
+	s.ops.mu.Lock()
+	defer s.ops.mu.Unlock()
+	if len(s.ops.pending) != 0 {
+		t.Error(s.ops.pending)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// everything frontdesk says (and the modes it sets) goes through
+// the outbox, which paces it so that we don't get kicked for
+// flooding. there's a token bucket for everything we send and one for
+// each target, so someone getting a pile of messages delivered
+// doesn't hold up replies to everyone else.
+
+type rateLimit struct {
+	// messages per second, once the burst is used up
+	rate  float64
+	burst int
+}
+
+var (
+	globalLimit = rateLimit{rate: 1, burst: 5}
+	targetLimit = rateLimit{rate: 0.5, burst: 3}
+)
+
+// servers add ":nick!user@host " to the front of what we send
+// before passing it on, and the whole thing has to fit in 512 bytes
+const (
+	maxLineLength   = 512
+	prefixAllowance = 100
+)
+
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.rate
+	if b.tokens > float64(b.limit.burst) {
+		b.tokens = float64(b.limit.burst)
+	}
+	b.last = now
+}
+
+// how long until there's a token to take
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.rate * float64(time.Second))
+}
+
+type outMessage struct {
+	conn   *irc.Conn
+	target string
+	text   string
+	// set for a MODE rather than a PRIVMSG
+	modes  []string
+	queued time.Time
+}
+
+type outbox struct {
+	target  rateLimit
+	started sync.Once
+
+	mu      sync.Mutex
+	queue   []outMessage
+	buckets map[string]*tokenBucket
+	all     *tokenBucket
+	wake    chan struct{}
+}
+
+func newOutbox(global, target rateLimit) *outbox {
+	return &outbox{
+		target:  target,
+		buckets: map[string]*tokenBucket{},
+		all:     newTokenBucket(global, time.Now()),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// queue up a message, split into as many lines as it takes
+func (o *outbox) privmsg(conn *irc.Conn, target, text string) {
+	max := maxLineLength - prefixAllowance - len("PRIVMSG  :\r\n") - len(target)
+	for _, part := range splitMessage(text, max) {
+		o.add(outMessage{conn: conn, target: target, text: part})
+	}
+}
+
+func (o *outbox) mode(conn *irc.Conn, channel string, modes ...string) {
+	o.add(outMessage{conn: conn, target: channel, modes: modes})
+}
+
+func (o *outbox) add(m outMessage) {
+	o.started.Do(func() { go o.run() })
+	m.queued = time.Now()
+	o.mu.Lock()
+	o.queue = append(o.queue, m)
+	o.mu.Unlock()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// the first queued message that we're allowed to send now. if there
+// isn't one, how long to wait before trying again (zero if there's
+// nothing queued at all)
+func (o *outbox) next(now time.Time) (outMessage, time.Duration, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.prune(now)
+	if len(o.queue) == 0 {
+		return outMessage{}, 0, false
+	}
+	if w := o.all.wait(now); w > 0 {
+		return outMessage{}, w, false
+	}
+	var shortest time.Duration
+	for i, m := range o.queue {
+		k := strings.ToLower(m.target)
+		b, ok := o.buckets[k]
+		if !ok {
+			b = newTokenBucket(o.target, now)
+			o.buckets[k] = b
+		}
+		if w := b.wait(now); w > 0 {
+			if shortest == 0 || w < shortest {
+				shortest = w
+			}
+			continue
+		}
+		b.tokens--
+		o.all.tokens--
+		o.queue = append(o.queue[:i], o.queue[i+1:]...)
+		return m, 0, true
+	}
+	return outMessage{}, shortest, false
+}
+
+// a bucket that's filled back up is no different from a new one, so
+// there's no need to keep it around. otherwise we'd have one for
+// everyone we've ever talked to. o.mu has to be held
+func (o *outbox) prune(now time.Time) {
+	for k, b := range o.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.burst) {
+			delete(o.buckets, k)
+		}
+	}
+}
+
+// how long the oldest message has been waiting, if there is one
+func (o *outbox) oldest(now time.Time) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var d time.Duration
+	for _, m := range o.queue {
+		if w := now.Sub(m.queued); w > d {
+			d = w
+		}
+	}
+	return d
+}
+
+func (o *outbox) run() {
+	for {
+		m, wait, ok := o.next(time.Now())
+		if ok {
+			if m.modes != nil {
+				m.conn.Mode(m.target, m.modes...)
+			} else {
+				m.conn.Privmsg(m.target, m.text)
+			}
+			continue
+		}
+		if wait == 0 {
+			<-o.wake
+			continue
+		}
+		select {
+		case <-o.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// break text up into pieces of at most max bytes, at spaces where
+// possible. IRC can't carry newlines, so those always split it
+func splitMessage(text string, max int) []string {
+	parts := []string{}
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimRight(l, "\r")
+		for len(l) > max {
+			cut := strings.LastIndex(l[:max+1], " ")
+			if cut < max/2 {
+				// no good place to break it, so just make sure we
+				// don't cut a character in half
+				cut = max
+				for cut > 0 && !utf8.RuneStart(l[cut]) {
+					cut--
+				}
+			}
+			parts = append(parts, strings.TrimRight(l[:cut], " "))
+			l = strings.TrimLeft(l[cut:], " ")
+		}
+		if l != "" {
+			parts = append(parts, l)
+		}
+	}
+	return parts
+}
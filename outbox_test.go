@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_splitMessage(t *testing.T) {
+	cases := []struct {
+		text     string
+		max      int
+		expected []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"", 10, []string{}},
+		{"one two three four", 9, []string{"one two", "three", "four"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		// don't split é
+		{"aaé", 3, []string{"aa", "é"}},
+		{"line one\r\nline two", 100, []string{"line one", "line two"}},
+	}
+	for _, c := range cases {
+		r := splitMessage(c.text, c.max)
+		if strings.Join(r, "|") != strings.Join(c.expected, "|") {
+			t.Errorf("%q: expected %q, got %q", c.text, c.expected, r)
+		}
+	}
+}
+
+func Test_outboxThrottling(t *testing.T) {
+	o := newOutbox(rateLimit{rate: 1, burst: 3}, rateLimit{rate: 0.5, burst: 2})
+	// queue without starting the sender, so we can drive it ourselves
+	o.started.Do(func() {})
+	for i := 0; i < 3; i++ {
+		o.privmsg(nil, "alice", "for alice")
+	}
+	o.privmsg(nil, "bob", "for bob")
+
+	now := time.Now()
+	sent := []string{}
+	for {
+		m, wait, ok := o.next(now)
+		if !ok {
+			if wait <= 0 {
+				t.Fatal("should be waiting on alice's bucket")
+			}
+			break
+		}
+		sent = append(sent, m.target)
+	}
+	// alice only gets two before she has to wait, and bob doesn't
+	// have to wait behind her
+	if strings.Join(sent, " ") != "alice alice bob" {
+		t.Error(sent)
+	}
+
+	// the global bucket is empty now too
+	if _, wait, _ := o.next(now); wait < time.Second {
+		t.Error(wait)
+	}
+	if m, _, ok := o.next(now.Add(2 * time.Second)); !ok || m.target != "alice" {
+		t.Error("alice should have her last one by now")
+	}
+	if _, wait, ok := o.next(now.Add(2 * time.Second)); ok || wait != 0 {
+		t.Error("that should be everything")
+	}
+}
+
+func Test_outboxLongMessages(t *testing.T) {
+	o := newOutbox(rateLimit{rate: 1, burst: 10}, rateLimit{rate: 1, burst: 10})
+	o.started.Do(func() {})
+	o.privmsg(nil, "alice", strings.Repeat("word ", 200))
+	n := 0
+	for {
+		m, _, ok := o.next(time.Now())
+		if !ok {
+			break
+		}
+		if l := len("PRIVMSG alice :"+m.text+"\r\n") + prefixAllowance; l > maxLineLength {
+			t.Error("too long", l)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Error("expected it in 3 pieces, got", n)
+	}
+}
+
+func Test_outboxForgetsIdleTargets(t *testing.T) {
+	o := newOutbox(rateLimit{rate: 1000, burst: 1000}, rateLimit{rate: 1, burst: 2})
+	o.started.Do(func() {})
+	for i := 0; i < 50; i++ {
+		o.privmsg(nil, fmt.Sprintf("nick%d", i), "hi")
+	}
+	now := time.Now()
+	for {
+		if _, _, ok := o.next(now); !ok {
+			break
+		}
+	}
+	if len(o.buckets) != 50 {
+		t.Error("they've all just been used", len(o.buckets))
+	}
+
+	// a while later, everyone's bucket is full again
+	o.privmsg(nil, "nick0", "again")
+	if _, _, ok := o.next(now.Add(5 * time.Second)); !ok {
+		t.Fatal("should have sent")
+	}
+	if len(o.buckets) != 1 {
+		t.Error("only nick0's bucket should be left", len(o.buckets))
+	}
+}
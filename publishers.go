@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/garyburd/go-oauth/oauth"
+	"github.com/xiam/twitter"
+)
+
+// when someone saves a link with .url, it gets sent on to every
+// publisher that's configured. each one is independent: one failing
+// doesn't stop the others, and how each one went is recorded on the
+// link.
+
+type linkPublisher interface {
+	name() string
+	publish(le linkEntry) error
+}
+
+type publishResult struct {
+	Publisher string
+	OK        bool
+	Error     string `json:",omitempty"`
+	Time      time.Time
+}
+
+var publishClient = &http.Client{Timeout: 10 * time.Second}
+
+// send the link everywhere, then save how that went
+func (s *site) publishLink(le linkEntry) error {
+	if len(s.publishers) == 0 {
+		return nil
+	}
+	for _, p := range s.publishers {
+		r := publishResult{Publisher: p.name(), OK: true, Time: time.Now()}
+		if err := p.publish(le); err != nil {
+			log.Println("couldn't publish", le.URL, "to", p.name(), err)
+			r.OK, r.Error = false, err.Error()
+			linksPublished.WithLabelValues(p.name(), "failed").Inc()
+		} else {
+			linksPublished.WithLabelValues(p.name(), "sent").Inc()
+		}
+		le.Published = append(le.Published, r)
+	}
+	data, err := json.Marshal(le)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("links")).Put([]byte(le.Key), data)
+	})
+}
+
+// POST a JSON body somewhere, and complain about anything but a 2xx
+func postJSON(u string, headers map[string]string, body interface{}) error {
+	return sendJSON("POST", u, headers, body)
+}
+
+func sendJSON(method, u string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := publishClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+type twitterPublisher struct {
+	site *site
+}
+
+func (p twitterPublisher) name() string {
+	return "twitter"
+}
+
+func (p twitterPublisher) publish(le linkEntry) error {
+	s := p.site
+	// shorten the link
+	url := s.shortenLink(le.URL)
+	log.Println("shortened:", url)
+	return s.postTweet(composeTweet(url, le.Title, s.handleFor(le.Nick, "twitter")))
+}
+
+// post a status to the channel's twitter account. links and .tweet
+// both go through here
+func (s *site) postTweet(text string) error {
+	client := twitter.New(&oauth.Credentials{
+		s.TwitterConsumerKey,
+		s.TwitterConsumerSecret,
+	})
+	client.SetAuth(&oauth.Credentials{
+		s.TwitterOauthToken,
+		s.TwitterOauthSecret,
+	})
+	_, err := client.VerifyCredentials(nil)
+	if err != nil {
+		tweets.WithLabelValues("failed").Inc()
+		return fmt.Errorf("twitter credentials are bad: %s", err)
+	}
+	_, err = client.Update(text, nil)
+	if err != nil {
+		tweets.WithLabelValues("failed").Inc()
+		return err
+	}
+	tweets.WithLabelValues("sent").Inc()
+	return nil
+}
+
+// posts a status to a Mastodon account
+type mastodonPublisher struct {
+	// eg https://mastodon.social
+	server string
+	token  string
+}
+
+func (p mastodonPublisher) name() string {
+	return "mastodon"
+}
+
+func (p mastodonPublisher) publish(le linkEntry) error {
+	return postJSON(strings.TrimRight(p.server, "/")+"/api/v1/statuses",
+		map[string]string{
+			"Authorization": "Bearer " + p.token,
+			// so a retry can't post it twice
+			"Idempotency-Key": le.Key,
+		},
+		map[string]string{"status": le.Title + " " + le.URL})
+}
+
+// POSTs the link, as it appears in the API, to any URL
+type webhookPublisher struct {
+	url  string
+	site *site
+}
+
+func (p webhookPublisher) name() string {
+	return "webhook"
+}
+
+func (p webhookPublisher) publish(le linkEntry) error {
+	return postJSON(p.url, nil, struct {
+		Event string  `json:"event"`
+		Link  apiLink `json:"link"`
+	}{"link", newAPILinks(p.site, []linkEntry{le})[0]})
+}
+
+// Slack's incoming webhooks. plenty of other things (Mattermost,
+// Discord's /slack endpoint, etc.) take the same thing
+type slackPublisher struct {
+	url  string
+	site *site
+}
+
+func (p slackPublisher) name() string {
+	return "slack"
+}
+
+// slack wants &, < and > escaped, and uses <url|text> for links
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func (p slackPublisher) publish(le linkEntry) error {
+	text := fmt.Sprintf("<%s|%s> from %s in %s (<%s|discussion>)",
+		le.URL, slackEscape(le.Title), slackEscape(le.Nick), slackEscape(le.Channel),
+		p.site.BaseURL+le.DiscussionLink())
+	return postJSON(p.url, nil, map[string]string{"text": text})
+}
+
+// sends a message to a Matrix room
+type matrixPublisher struct {
+	// eg https://matrix.org
+	homeserver string
+	token      string
+	room       string
+}
+
+func (p matrixPublisher) name() string {
+	return "matrix"
+}
+
+// matrix wants a different transaction ID for every message we send
+var matrixTxn int64
+
+func (p matrixPublisher) publish(le linkEntry) error {
+	txn := fmt.Sprintf("frontdesk-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&matrixTxn, 1))
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimRight(p.homeserver, "/"), url.PathEscape(p.room), txn)
+	return sendJSON("PUT", u, map[string]string{"Authorization": "Bearer " + p.token},
+		map[string]string{
+			"msgtype": "m.text",
+			"body":    fmt.Sprintf("%s %s (from %s)", le.Title, le.URL, le.Nick),
+		})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type capturedRequest struct {
+	method string
+	path   string
+	auth   string
+	body   map[string]interface{}
+}
+
+// records everything sent to it. anything under /broken/ fails
+func publishSink() (*httptest.Server, func() []capturedRequest) {
+	var mu sync.Mutex
+	reqs := []capturedRequest{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		json.Unmarshal(data, &body)
+		mu.Lock()
+		reqs = append(reqs, capturedRequest{r.Method, r.URL.EscapedPath(), r.Header.Get("Authorization"), body})
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/broken/") {
+			http.Error(w, "nope", 500)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	return ts, func() []capturedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]capturedRequest{}, reqs...)
+	}
+}
+
+func Test_publishLink(t *testing.T) {
+	ts, requests := publishSink()
+	defer ts.Close()
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.publishers = []linkPublisher{
+		mastodonPublisher{ts.URL + "/", "mtoken"},
+		webhookPublisher{ts.URL + "/hook", s},
+		slackPublisher{ts.URL + "/broken/slack", s},
+		matrixPublisher{ts.URL, "xtoken", "!room:example.com"},
+	}
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+
+	ts0, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	s.channelLogger.Handle(conn, testLine("alice", "#one", ".url http://example.com/ A <good> link", ts0))
+	expectLine(t, lines, "PRIVMSG alice :saved your link")
+	s.channelLogger.wait()
+
+	reqs := requests()
+	if len(reqs) != 4 {
+		t.Fatal(reqs)
+	}
+	if r := reqs[0]; r.path != "/api/v1/statuses" || r.auth != "Bearer mtoken" ||
+		r.body["status"] != "A <good> link http://example.com/" {
+		t.Error("mastodon", r)
+	}
+	if r := reqs[1]; r.body["event"] != "link" || r.body["link"].(map[string]interface{})["nick"] != "alice" {
+		t.Error("webhook", r)
+	}
+	if r := reqs[2]; !strings.HasPrefix(r.body["text"].(string), "<http://example.com/|A &lt;good&gt; link> from alice in #one") {
+		t.Error("slack", r)
+	}
+	if r := reqs[3]; r.method != "PUT" || !strings.HasPrefix(r.path, "/_matrix/client/v3/rooms/%21room:example.com/send/m.room.message/") ||
+		r.auth != "Bearer xtoken" || r.body["msgtype"] != "m.text" {
+		t.Error("matrix", r)
+	}
+
+	links, _, _ := s.links(linkFilter{}, "", 10)
+	if len(links) != 1 || len(links[0].Published) != 4 {
+		t.Fatal(links)
+	}
+	for _, r := range links[0].Published {
+		if r.OK != (r.Publisher != "slack") {
+			t.Error(r)
+		}
+	}
+	if p := links[0].Published[2]; !strings.Contains(p.Error, "500") {
+		t.Error(p)
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis/analyzers/keyword_analyzer"
+	"github.com/boltdb/bolt"
 )
 
 func buildIndexMapping() (*bleve.IndexMapping, error) {
@@ -15,10 +22,173 @@ func buildIndexMapping() (*bleve.IndexMapping, error) {
 	lineMapping := bleve.NewDocumentMapping()
 	lineMapping.AddFieldMappingsAt("nick", keywordFieldMapping)
 	lineMapping.AddFieldMappingsAt("text", englishTextFieldMapping)
+	lineMapping.AddFieldMappingsAt("Channel", keywordFieldMapping)
+
+	linkMapping := bleve.NewDocumentMapping()
+	linkMapping.AddFieldMappingsAt("doctype", keywordFieldMapping)
+	linkMapping.AddFieldMappingsAt("title", englishTextFieldMapping)
+	linkMapping.AddFieldMappingsAt("url", englishTextFieldMapping)
+	linkMapping.AddFieldMappingsAt("domain", keywordFieldMapping)
+	linkMapping.AddFieldMappingsAt("nick", keywordFieldMapping)
+	linkMapping.AddFieldMappingsAt("channel", keywordFieldMapping)
+	linkMapping.AddFieldMappingsAt("date", bleve.NewDateTimeFieldMapping())
 
 	indexMapping := bleve.NewIndexMapping()
 	indexMapping.AddDocumentMapping("line", lineMapping)
+	indexMapping.AddDocumentMapping("link", linkMapping)
 
 	indexMapping.DefaultAnalyzer = "en"
 	return indexMapping, nil
 }
+
+// links go in the same index as lines, as their own type of
+// document. lines have never had a doctype, so that's how we tell
+// them apart
+type linkDoc struct {
+	DocType string    `json:"doctype"`
+	Title   string    `json:"title"`
+	URL     string    `json:"url"`
+	Domain  string    `json:"domain"`
+	Nick    string    `json:"nick"`
+	Channel string    `json:"channel"`
+	Date    time.Time `json:"date"`
+}
+
+func (d linkDoc) Type() string {
+	return "link"
+}
+
+const linkDocPrefix = "link "
+
+func linkDocID(le linkEntry) string {
+	return linkDocPrefix + le.Key
+}
+
+func newLinkDoc(le linkEntry) linkDoc {
+	return linkDoc{
+		DocType: "link",
+		Title:   le.Title,
+		URL:     le.URL,
+		Domain:  linkDomain(le.URL),
+		Nick:    le.Nick,
+		Channel: le.Channel,
+		Date:    le.Timestamp,
+	}
+}
+
+func (s *site) indexLink(le linkEntry) error {
+	return s.index.Index(linkDocID(le), newLinkDoc(le))
+}
+
+func isLinkDoc() bleve.Query {
+	return bleve.NewTermQuery("link").SetField("doctype")
+}
+
+// how many of each kind of document are in the index
+func (s site) indexCounts() (lines, links uint64, err error) {
+	total, err := s.index.DocCount()
+	if err != nil {
+		return 0, 0, err
+	}
+	result, err := s.index.Search(bleve.NewSearchRequestOptions(isLinkDoc(), 0, 0, false))
+	if err != nil {
+		return 0, 0, err
+	}
+	if result.Total > total {
+		return 0, result.Total, nil
+	}
+	return total - result.Total, result.Total, nil
+}
+
+// search the logs, leaving out any links
+func (s site) searchLines(q string, size, from int) (*bleve.SearchResult, []lineEntry, error) {
+	query := bleve.NewBooleanQuery(
+		[]bleve.Query{bleve.NewQueryStringQuery(q)}, nil, []bleve.Query{isLinkDoc()})
+	result, err := s.index.Search(bleve.NewSearchRequestOptions(query, size, from, false))
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := []string{}
+	for _, m := range result.Hits {
+		keys = append(keys, m.ID)
+	}
+	lines, err := s.getLines(keys)
+	return result, lines, err
+}
+
+// search just the links
+func (s site) searchLinks(q string, size, from int) (*bleve.SearchResult, []linkEntry, error) {
+	query := bleve.NewConjunctionQuery([]bleve.Query{bleve.NewQueryStringQuery(q), isLinkDoc()})
+	result, err := s.index.Search(bleve.NewSearchRequestOptions(query, size, from, false))
+	if err != nil {
+		return nil, nil, err
+	}
+	links := []linkEntry{}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("links"))
+		for _, m := range result.Hits {
+			v := b.Get([]byte(strings.TrimPrefix(m.ID, linkDocPrefix)))
+			if v == nil {
+				continue
+			}
+			var le linkEntry
+			if err := json.Unmarshal(v, &le); err != nil {
+				return err
+			}
+			links = append(links, le)
+		}
+		return nil
+	})
+	return result, links, err
+}
+
+var linksIndexed = []byte("links indexed")
+
+var errBackfillStopped = errors.New("stopped indexing links to shut down")
+
+// links saved before they were searchable need to be put in the
+// index, once. the "meta" bucket remembers that it's been done. if we
+// shut down part way through, it starts again next time
+func (s *site) backfillLinkIndex() error {
+	done := false
+	s.db.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket([]byte("meta")).Get(linksIndexed) != nil
+		return nil
+	})
+	if done {
+		return nil
+	}
+	batch := s.index.NewBatch()
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("links")).ForEach(func(k, v []byte) error {
+			var le linkEntry
+			if err := json.Unmarshal(v, &le); err != nil {
+				return err
+			}
+			n++
+			if err := batch.Index(linkDocID(le), newLinkDoc(le)); err != nil {
+				return err
+			}
+			if batch.Size() < 100 {
+				return nil
+			}
+			if s.isStopping() {
+				return errBackfillStopped
+			}
+			err := s.index.Batch(batch)
+			batch = s.index.NewBatch()
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.index.Batch(batch); err != nil {
+		return err
+	}
+	log.Println("indexed", n, "links")
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("meta")).Put(linksIndexed, []byte(time.Now().Format(time.RFC3339)))
+	})
+}
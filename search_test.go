@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+func Test_searchLinesByChannel(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one", "#two")
+	defer cleanup()
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	one := lineEntry{Nick: "alice", Text: "postgres vacuuming", Timestamp: ts, Channel: "#one", Kind: kindMessage}
+	two := lineEntry{Nick: "bob", Text: "postgres vacuuming", Timestamp: ts, Channel: "#two", Kind: kindMessage}
+	for _, le := range []lineEntry{one, two} {
+		if err := s.channelLogger.storeLine(le); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the whole channel name is the term, # and all
+	for _, le := range []lineEntry{one, two} {
+		q := bleve.NewTermQuery(le.Channel).SetField("Channel")
+		result, err := s.index.Search(bleve.NewSearchRequest(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Total != 1 || result.Hits[0].ID != le.DocID() {
+			t.Error(le.Channel, result.Hits)
+		}
+	}
+}
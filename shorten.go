@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/thraxil/bitly"
+)
+
+// links get shortened before they're tweeted. there's bit.ly, anything
+// that'll take a POST and hand back a short link, or our own: codes in
+// bolt, served as redirects from /s/<code>, which lets us count clicks.
+//
+// the built in one keeps a shortLink under each code in the
+// "shortcodes" bucket, and the code for each URL in "shorturls", so the
+// same URL always gets the same code.
+
+type shortener interface {
+	name() string
+	shorten(u string) (string, error)
+}
+
+func newShortener(cfg config, s *site) (shortener, error) {
+	switch cfg.Shortener {
+	case "bitly":
+		if cfg.BitlyAccessToken == "" {
+			return nil, errors.New("the bitly shortener needs FRONTDESK_BITLY_ACCESS_TOKEN")
+		}
+		return bitlyShortener{cfg.BitlyAccessToken}, nil
+	case "post":
+		if cfg.ShortenerURL == "" {
+			return nil, errors.New("the post shortener needs FRONTDESK_SHORTENER_URL")
+		}
+		return postShortener{cfg.ShortenerURL, cfg.ShortenerField}, nil
+	case "builtin":
+		if cfg.BaseURL == "" {
+			return nil, errors.New("the builtin shortener needs FRONTDESK_BASE_URL")
+		}
+		return builtinShortener{s}, nil
+	}
+	return nil, fmt.Errorf("unknown shortener %q (bitly, post or builtin)", cfg.Shortener)
+}
+
+// the short version of u, or u itself if we can't get one
+func (s site) shortenLink(u string) string {
+	if s.shortener == nil {
+		return u
+	}
+	short, err := s.shortener.shorten(u)
+	if err != nil {
+		log.Println("couldn't shorten", u, "with", s.shortener.name(), err)
+		linksShortened.WithLabelValues(s.shortener.name(), "failed").Inc()
+		return u
+	}
+	linksShortened.WithLabelValues(s.shortener.name(), "shortened").Inc()
+	return short
+}
+
+type bitlyShortener struct {
+	token string
+}
+
+func (b bitlyShortener) name() string {
+	return "bitly"
+}
+
+func (b bitlyShortener) shorten(u string) (string, error) {
+	short, err := bitly.NewConnection(b.token).Shorten(u)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(short, "\n\r "), nil
+}
+
+// POSTs url=<the link> to a shortening service. the response is the
+// short link, either all by itself, or in a field of a JSON object
+type postShortener struct {
+	url string
+	// empty if the whole response is the link
+	field string
+}
+
+func (p postShortener) name() string {
+	return "post"
+}
+
+func (p postShortener) shorten(u string) (string, error) {
+	resp, err := publishClient.PostForm(p.url, url.Values{"url": {u}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	short := strings.TrimSpace(string(body))
+	if p.field != "" {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return "", err
+		}
+		short, _ = fields[p.field].(string)
+	}
+	if parsed, err := url.Parse(short); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", fmt.Errorf("didn't get a link back: %q", short)
+	}
+	return short, nil
+}
+
+const (
+	shortCodeLength = 6
+	shortCodeChars  = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+type shortLink struct {
+	URL     string    `json:"url"`
+	Created time.Time `json:"created"`
+	Clicks  int       `json:"clicks"`
+}
+
+type builtinShortener struct {
+	site *site
+}
+
+func (b builtinShortener) name() string {
+	return "builtin"
+}
+
+func newShortCode() (string, error) {
+	code := make([]byte, shortCodeLength)
+	max := big.NewInt(int64(len(shortCodeChars)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shortCodeChars[n.Int64()]
+	}
+	return string(code), nil
+}
+
+func (b builtinShortener) shorten(u string) (string, error) {
+	if b.site.BaseURL == "" {
+		return "", errors.New("FRONTDESK_BASE_URL isn't set")
+	}
+	var code string
+	err := b.site.db.Update(func(tx *bolt.Tx) error {
+		urls := tx.Bucket([]byte("shorturls"))
+		if c := urls.Get([]byte(u)); c != nil {
+			code = string(c)
+			return nil
+		}
+		codes := tx.Bucket([]byte("shortcodes"))
+		for {
+			c, err := newShortCode()
+			if err != nil {
+				return err
+			}
+			if codes.Get([]byte(c)) == nil {
+				code = c
+				break
+			}
+		}
+		data, err := json.Marshal(shortLink{URL: u, Created: time.Now()})
+		if err != nil {
+			return err
+		}
+		if err := codes.Put([]byte(code), data); err != nil {
+			return err
+		}
+		return urls.Put([]byte(u), []byte(code))
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(b.site.BaseURL, "/") + "/s/" + code, nil
+}
+
+// count a click on code and say where it goes. ok is false if it
+// isn't one of ours
+func (s site) followShortLink(code string) (string, bool, error) {
+	var sl shortLink
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("shortcodes"))
+		v := b.Get([]byte(code))
+		if v == nil {
+			return nil
+		}
+		found = true
+		if err := json.Unmarshal(v, &sl); err != nil {
+			return err
+		}
+		sl.Clicks++
+		data, err := json.Marshal(sl)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(code), data)
+	})
+	return sl.URL, found, err
+}
+
+// how many times each of these links has been clicked through our
+// short links. links we haven't shortened aren't in it
+func (s site) shortLinkClicks(links []linkEntry) (map[string]int, error) {
+	clicks := map[string]int{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		urls := tx.Bucket([]byte("shorturls"))
+		codes := tx.Bucket([]byte("shortcodes"))
+		for _, le := range links {
+			code := urls.Get([]byte(le.URL))
+			if code == nil {
+				continue
+			}
+			var sl shortLink
+			if err := json.Unmarshal(codes.Get(code), &sl); err != nil {
+				return err
+			}
+			clicks[le.URL] = sl.Clicks
+		}
+		return nil
+	})
+	return clicks, err
+}
+
+// /s/<code>
+func shortLinkHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	u, ok, err := s.followShortLink(code)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// not a 301, or browsers would skip us next time and we'd miss
+	// the click
+	http.Redirect(w, r, u, http.StatusFound)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_postShortener(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.FormValue("url")
+		switch r.URL.Path {
+		case "/plain":
+			fmt.Fprintln(w, "https://sho.rt/abc")
+		case "/json":
+			fmt.Fprint(w, `{"short_url": "https://sho.rt/def", "long_url": "whatever"}`)
+		case "/junk":
+			fmt.Fprint(w, "<html>nope</html>")
+		default:
+			http.Error(w, "no", 500)
+		}
+	}))
+	defer ts.Close()
+
+	short, err := postShortener{url: ts.URL + "/plain"}.shorten("http://example.com/long")
+	if err != nil || short != "https://sho.rt/abc" {
+		t.Error(short, err)
+	}
+	if got != "http://example.com/long" {
+		t.Error(got)
+	}
+	short, err = postShortener{url: ts.URL + "/json", field: "short_url"}.shorten("http://example.com/long")
+	if err != nil || short != "https://sho.rt/def" {
+		t.Error(short, err)
+	}
+	if _, err := (postShortener{url: ts.URL + "/junk"}).shorten("http://example.com/long"); err == nil {
+		t.Error("that wasn't a link")
+	}
+	if _, err := (postShortener{url: ts.URL + "/broken"}).shorten("http://example.com/long"); err == nil {
+		t.Error("should have failed")
+	}
+
+	// which falls back to the long one
+	s := &site{shortener: postShortener{url: ts.URL + "/broken"}}
+	if u := s.shortenLink("http://example.com/long"); u != "http://example.com/long" {
+		t.Error(u)
+	}
+	s.shortener = nil
+	if u := s.shortenLink("http://example.com/long"); u != "http://example.com/long" {
+		t.Error(u)
+	}
+}
+
+func Test_builtinShortener(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.shortener = builtinShortener{s}
+
+	short := s.shortenLink("http://example.com/a")
+	if !strings.HasPrefix(short, "http://example.com/s/") || len(short) != len("http://example.com/s/")+shortCodeLength {
+		t.Fatal(short)
+	}
+	if again := s.shortenLink("http://example.com/a"); again != short {
+		t.Error("same URL, same code", again, short)
+	}
+	if other := s.shortenLink("http://example.com/b"); other == short {
+		t.Error("different URLs need different codes")
+	}
+
+	follow := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		shortLinkHandler(w, httptest.NewRequest("GET", path, nil), s)
+		return w
+	}
+	code := strings.TrimPrefix(short, "http://example.com")
+	for i := 0; i < 3; i++ {
+		w := follow(code)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "http://example.com/a" {
+			t.Fatal(w.Code, w.Header())
+		}
+	}
+	if w := follow("/s/nope"); w.Code != 404 {
+		t.Error(w.Code)
+	}
+
+	now := time.Now()
+	links := []linkEntry{
+		{Key: now.Format(time.RFC3339Nano), Channel: "#one", Nick: "alice", URL: "http://example.com/a", Title: "A", Timestamp: now},
+		{Key: now.Add(time.Second).Format(time.RFC3339Nano), Channel: "#one", Nick: "alice", URL: "http://example.com/c", Title: "C", Timestamp: now.Add(time.Second)},
+	}
+	clicks, err := s.shortLinkClicks(links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clicks) != 1 || clicks["http://example.com/a"] != 3 {
+		t.Error(clicks)
+	}
+
+	for _, le := range links {
+		if err := s.storeLink(le); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	linksHandler(w, httptest.NewRequest("GET", "/links/", nil), s)
+	if !strings.Contains(w.Body.String(), `<span class="badge" title="clicks">3</span>`) {
+		t.Error(w.Body.String())
+	}
+}
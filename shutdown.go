@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// how long we give the IRC server to hang up on us, and the web
+// server to finish whatever it's in the middle of
+var shutdownTimeout = 10 * time.Second
+
+// whether we've been asked to shut down
+func (s *site) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// let shutdown know the IRC connection is gone
+func (s *site) markDisconnected() {
+	select {
+	case s.disconnected <- struct{}{}:
+	default:
+	}
+}
+
+// say goodbye on IRC, let anything still writing to the db finish,
+// then close everything that holds files open
+func (s *site) shutdown(conn *irc.Conn, srv *http.Server, quitMessage string) {
+	log.Println("shutting down")
+	close(s.stopping)
+
+	if conn != nil && conn.Connected() {
+		conn.Quit(quitMessage)
+		select {
+		case <-s.disconnected:
+		case <-time.After(shutdownTimeout):
+			log.Println("server didn't hang up on us, closing the connection")
+			conn.Close()
+		}
+	}
+
+	// mentions and commands still running in the background, and
+	// the link backfill
+	s.channelLogger.wait()
+
+	// digests that are still gathering mentions
+	if s.mailer != nil {
+		s.mailer.flushAll()
+	}
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("couldn't shut down the web server cleanly:", err)
+		}
+	}
+
+	if err := s.index.Close(); err != nil {
+		log.Println("couldn't close the index:", err)
+	}
+	if err := s.db.Close(); err != nil {
+		log.Println("couldn't close the db:", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_shutdown(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+
+	// the fake server never hangs up on us, so don't wait around
+	defer func(d time.Duration) { shutdownTimeout = d }(shutdownTimeout)
+	shutdownTimeout = 100 * time.Millisecond
+
+	s.shutdown(conn, &http.Server{}, "see you later")
+	expectLine(t, lines, "QUIT :see you later")
+	if conn.Connected() {
+		t.Error("should have closed the connection")
+	}
+	if !s.isStopping() {
+		t.Error("should be stopping")
+	}
+	if err := s.db.View(func(tx *bolt.Tx) error { return nil }); err == nil {
+		t.Error("db should be closed")
+	}
+
+	// and nothing should try to get back on IRC
+	done := make(chan struct{})
+	go func() {
+		connect(conn, s.stopping)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("connect should give up once we're stopping")
+	}
+}
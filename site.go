@@ -1,24 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/blevesearch/bleve"
 	"github.com/boltdb/bolt"
 	irc "github.com/fluffle/goirc/client"
-	"github.com/garyburd/go-oauth/oauth"
-	"github.com/thraxil/bitly"
-	"github.com/xiam/twitter"
 )
 
 type site struct {
 	channelLogger *channelLogger
 	userLogger    *userLogger
+	nickAuth      *nickAuth
+	mailer        *mailer
+	ops           *ops
+	tweeters      *tweeters
+	outbox        *outbox
+	spool         *spool
+	fetcher       *titleFetcher
+	publishers    []linkPublisher
+	shortener     shortener
+	health        *health
+	conn          *irc.Conn
+	stopping      chan struct{}
+	disconnected  chan struct{}
+	channels      []string
 	db            *bolt.DB
 	index         bleve.Index
 	BaseURL       string
@@ -32,26 +44,226 @@ type site struct {
 	TwitterConsumerSecret string
 }
 
-func newSite(db *bolt.DB, index bleve.Index, conn *irc.Conn, channel, baseURL,
+func newSite(db *bolt.DB, index bleve.Index, conn *irc.Conn, channels []string, baseURL,
 	htpasswdFile, handleFile, bitlyAccessToken, twitterOauthToken, twitterOauthSecret, twitterConsumerKey,
 	twitterConsumerSecret string) *site {
 	s := &site{
-		db: db, index: index, BaseURL: baseURL, HtpasswdFile: htpasswdFile,
+		db: db, index: index, conn: conn, channels: channels,
+		BaseURL: baseURL, HtpasswdFile: htpasswdFile,
 		HandleFile:            handleFile,
 		BitlyAccessToken:      bitlyAccessToken,
 		TwitterOauthToken:     twitterOauthToken,
 		TwitterOauthSecret:    twitterOauthSecret,
 		TwitterConsumerKey:    twitterConsumerKey,
 		TwitterConsumerSecret: twitterConsumerSecret,
+		outbox:                newOutbox(globalLimit, targetLimit),
+		stopping:              make(chan struct{}),
+		disconnected:          make(chan struct{}, 1),
+		health:                newHealth(0),
 	}
-	cl := newChannelLogger(db, channel, s)
-	ul := newUserLogger(db, conn, channel, s)
+	cl := newChannelLogger(db, s)
+	ul := newUserLogger(db, conn, s)
 	s.channelLogger = cl
 	s.userLogger = ul
+	s.spool = newSpool(db.Path() + ".spool")
+	if twitterOauthToken != "" {
+		s.publishers = append(s.publishers, twitterPublisher{s})
+	}
+	s.tweeters = newTweeters(s, nil)
+	s.ops = newOps(s, nil)
+	if bitlyAccessToken != "" {
+		s.shortener = bitlyShortener{bitlyAccessToken}
+	}
 	s.ensureBuckets()
+	s.migrateLines()
+	s.migrateEmails()
+	s.migrateMentions()
+	if handleFile != "" {
+		n, err := s.importHandleFile(handleFile)
+		if err != nil {
+			log.Println("couldn't import handle file:", err)
+		} else if n > 0 {
+			log.Println("imported", n, "handles from", handleFile)
+		}
+	}
 	return s
 }
 
+// the first configured channel. old URLs and search results from
+// before we supported multiple channels belong to it
+func (s site) defaultChannel() string {
+	if len(s.channels) == 0 {
+		return ""
+	}
+	return s.channels[0]
+}
+
+// channel names are case insensitive, so this returns the
+// configured spelling of a channel name that we see on the wire
+func (s site) configuredChannel(target string) (string, bool) {
+	for _, c := range s.channels {
+		if strings.EqualFold(c, target) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+func (s site) channelForSlug(slug string) (string, bool) {
+	for _, c := range s.channels {
+		if strings.EqualFold(channelSlug(c), slug) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+func isYear(k string) bool {
+	if len(k) != 4 {
+		return false
+	}
+	for _, r := range k {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// .email used to keep addresses in their own "emails" bucket. they're
+// email handles now
+func (s *site) migrateEmails() {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		emails := tx.Bucket([]byte("emails"))
+		if emails == nil {
+			return nil
+		}
+		log.Println("moving email addresses to handles")
+		err := emails.ForEach(func(k, v []byte) error {
+			handles, err := getHandles(tx, string(k))
+			if err != nil {
+				return err
+			}
+			if handles["email"] != "" {
+				return nil
+			}
+			handles["email"] = string(v)
+			return putHandles(tx, string(k), handles)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte("emails"))
+	})
+	if err != nil {
+		log.Println("couldn't move email addresses:", err)
+	}
+}
+
+// mentions used to be kept under the nick as it was typed, so a .tell
+// for Alice never got to alice. put them all under the lowercased nick
+func (s *site) migrateMentions() {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mentions"))
+		old := [][]byte{}
+		b.ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, mentionKey(string(k))) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		for _, k := range old {
+			var from, to mentions
+			if err := json.Unmarshal(b.Get(k), &from); err != nil {
+				return err
+			}
+			key := mentionKey(string(k))
+			if v := b.Get(key); v != nil {
+				if err := json.Unmarshal(v, &to); err != nil {
+					return err
+				}
+			}
+			to.Mentions = append(to.Mentions, from.Mentions...)
+			sort.SliceStable(to.Mentions, func(i, j int) bool {
+				return to.Mentions[i].Timestamp.Before(to.Mentions[j].Timestamp)
+			})
+			data, err := json.Marshal(to)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("couldn't move mentions:", err)
+	}
+}
+
+// before frontdesk could log multiple channels, lines were stored
+// directly under lines/YYYY/MM/DD. move any of those under the
+// default channel.
+func (s *site) migrateLines() {
+	channel := s.defaultChannel()
+	if channel == "" {
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		lines := tx.Bucket([]byte("lines"))
+		years := []string{}
+		lines.ForEach(func(k, v []byte) error {
+			if v == nil && isYear(string(k)) {
+				years = append(years, string(k))
+			}
+			return nil
+		})
+		if len(years) == 0 {
+			return nil
+		}
+		log.Println("moving old logs to", channel)
+		cb, err := lines.CreateBucketIfNotExists([]byte(channel))
+		if err != nil {
+			return err
+		}
+		for _, y := range years {
+			yb, err := cb.CreateBucketIfNotExists([]byte(y))
+			if err != nil {
+				return err
+			}
+			err = copyBucket(lines.Bucket([]byte(y)), yb)
+			if err != nil {
+				return err
+			}
+			err = lines.DeleteBucket([]byte(y))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func copyBucket(src, dst *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			sub, err := dst.CreateBucketIfNotExists(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(src.Bucket(k), sub)
+		}
+		return dst.Put(k, v)
+	})
+}
+
 func (s *site) ensureBuckets() {
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte("lines"))
@@ -71,6 +283,38 @@ func (s *site) ensureBuckets() {
 			return err
 		}
 		_, err = tx.CreateBucketIfNotExists([]byte("nicks"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("aliases"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("ops"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("oplog"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("tweets"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("shortcodes"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("shorturls"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("handles"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("meta"))
 		return err
 	})
 	if err != nil {
@@ -79,29 +323,45 @@ func (s *site) ensureBuckets() {
 	return
 }
 
-func (s site) years() []string {
+func channelBucket(tx *bolt.Tx, channel string) *bolt.Bucket {
+	return tx.Bucket([]byte("lines")).Bucket([]byte(channel))
+}
+
+func (s site) years(channel string) ([]string, error) {
 	years := []string{}
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("lines"))
+		b := channelBucket(tx, channel)
+		if b == nil {
+			return nil
+		}
 		b.ForEach(func(k, v []byte) error {
 			years = append(years, string(k))
 			return nil
 		})
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return years
+	return years, err
 }
 
-func (s site) linesForDay(year, month, day string) []lineEntry {
+func (s site) linesForDay(channel, year, month, day string) ([]lineEntry, error) {
 	entries := []lineEntry{}
 	err := s.db.View(func(tx *bolt.Tx) error {
-		lb := tx.Bucket([]byte("lines"))
-		yb := lb.Bucket([]byte(year))
+		cb := channelBucket(tx, channel)
+		if cb == nil {
+			return nil
+		}
+		yb := cb.Bucket([]byte(year))
+		if yb == nil {
+			return nil
+		}
 		mb := yb.Bucket([]byte(month))
+		if mb == nil {
+			return nil
+		}
 		db := mb.Bucket([]byte(day))
+		if db == nil {
+			return nil
+		}
 		db.ForEach(func(k, v []byte) error {
 			var e lineEntry
 			err := json.Unmarshal(v, &e)
@@ -113,24 +373,38 @@ func (s site) linesForDay(year, month, day string) []lineEntry {
 		})
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return entries
+	return entries, err
 }
 
-func (s site) getLines(keys []string) []lineEntry {
+// fetch lines by their search index IDs (see lineEntry.DocID)
+func (s site) getLines(ids []string) ([]lineEntry, error) {
 	entries := []lineEntry{}
 	err := s.db.View(func(tx *bolt.Tx) error {
-		lb := tx.Bucket([]byte("lines"))
-		for _, k := range keys {
+		for _, id := range ids {
+			channel, k := s.defaultChannel(), id
+			if i := strings.LastIndex(id, " "); i != -1 {
+				channel, k = id[:i], id[i+1:]
+			}
 			t, err := time.Parse(time.RFC3339Nano, k)
 			if err != nil {
 				continue
 			}
-			yb := lb.Bucket([]byte(fmt.Sprintf("%04d", t.Year())))
+			cb := channelBucket(tx, channel)
+			if cb == nil {
+				continue
+			}
+			yb := cb.Bucket([]byte(fmt.Sprintf("%04d", t.Year())))
+			if yb == nil {
+				continue
+			}
 			mb := yb.Bucket([]byte(fmt.Sprintf("%02d", t.Month())))
+			if mb == nil {
+				continue
+			}
 			db := mb.Bucket([]byte(fmt.Sprintf("%02d", t.Day())))
+			if db == nil {
+				continue
+			}
 			v := db.Get([]byte(k))
 			if v == nil {
 				continue
@@ -140,53 +414,62 @@ func (s site) getLines(keys []string) []lineEntry {
 			if err != nil {
 				continue
 			}
+			if e.Channel == "" {
+				e.Channel = channel
+			}
 			entries = append(entries, e)
 		}
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return entries
+	return entries, err
 }
 
-func (s site) daysForMonth(year, month string) []string {
+func (s site) daysForMonth(channel, year, month string) ([]string, error) {
 	entries := []string{}
 	err := s.db.View(func(tx *bolt.Tx) error {
-		lb := tx.Bucket([]byte("lines"))
-		yb := lb.Bucket([]byte(year))
+		cb := channelBucket(tx, channel)
+		if cb == nil {
+			return nil
+		}
+		yb := cb.Bucket([]byte(year))
+		if yb == nil {
+			return nil
+		}
 		mb := yb.Bucket([]byte(month))
+		if mb == nil {
+			return nil
+		}
 		mb.ForEach(func(k, v []byte) error {
 			entries = append(entries, string(k))
 			return nil
 		})
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return entries
+	return entries, err
 }
 
-func (s site) monthsForYear(year string) []string {
+func (s site) monthsForYear(channel, year string) ([]string, error) {
 	entries := []string{}
 	err := s.db.View(func(tx *bolt.Tx) error {
-		lb := tx.Bucket([]byte("lines"))
-		yb := lb.Bucket([]byte(year))
+		cb := channelBucket(tx, channel)
+		if cb == nil {
+			return nil
+		}
+		yb := cb.Bucket([]byte(year))
+		if yb == nil {
+			return nil
+		}
 		yb.ForEach(func(k, v []byte) error {
 			entries = append(entries, string(k))
 			return nil
 		})
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return entries
+	return entries, err
 }
 
 // all the nicks we've ever seen.
-func (s site) allKnownNicks() []string {
+func (s site) allKnownNicks() ([]string, error) {
 	nicks := []string{}
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("nicks"))
@@ -196,35 +479,53 @@ func (s site) allKnownNicks() []string {
 		})
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return nicks
+	return nicks, err
 }
 
-func (s site) onlineNicks() map[string]bool {
+func (s site) onlineNicks() (map[string]bool, error) {
 	nicks := map[string]bool{}
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("online"))
-		v := b.Get([]byte("now"))
-		if v == nil {
-			return nil
+		for _, channel := range s.channels {
+			v := b.Get([]byte(channel))
+			if v == nil {
+				continue
+			}
+			for _, n := range strings.Split(string(v), " ") {
+				nicks[normalizeNick(n)] = true
+			}
 		}
-		for _, n := range strings.Split(string(v), " ") {
-			nicks[normalizeNick(n)] = true
+		return nil
+	})
+	return nicks, err
+}
+
+// the configured channels that nick is in right now
+func (s site) channelsFor(nick string) ([]string, error) {
+	channels := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("online"))
+		for _, channel := range s.channels {
+			v := b.Get([]byte(channel))
+			if v != nil && containsNick(strings.Split(string(v), " "), nick) {
+				channels = append(channels, channel)
+			}
 		}
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return nicks
+	return channels, err
 }
 
-func (s site) offlineNicks() []string {
-	allNicks := s.allKnownNicks()
-	onlineNicks := s.onlineNicks()
+func (s site) offlineNicks() ([]string, error) {
+	allNicks, err := s.allKnownNicks()
+	if err != nil {
+		return nil, err
+	}
+	onlineNicks, err := s.onlineNicks()
+	if err != nil {
+		return nil, err
+	}
 	offlineNicks := []string{}
 	for _, n := range allNicks {
 		_, ok := onlineNicks[n]
@@ -232,7 +533,7 @@ func (s site) offlineNicks() []string {
 			offlineNicks = append(offlineNicks, n)
 		}
 	}
-	return offlineNicks
+	return offlineNicks, nil
 }
 
 type linkEntry struct {
@@ -244,6 +545,14 @@ type linkEntry struct {
 	Day       int
 	Key       string
 	Timestamp time.Time
+	Channel   string
+
+	// picked up from a URL someone pasted, rather than saved with .url
+	Auto        bool   `json:",omitempty"`
+	Description string `json:",omitempty"`
+
+	// how sending it on to twitter etc. went
+	Published []publishResult `json:",omitempty"`
 }
 
 func (e linkEntry) FormattedTimestamp() string {
@@ -251,142 +560,76 @@ func (e linkEntry) FormattedTimestamp() string {
 }
 
 func (e linkEntry) DiscussionLink() string {
-	return fmt.Sprintf("/logs/%04d/%02d/%02d/#%s", e.Year, e.Month, e.Day, e.Key)
+	return dayURL(e.Channel, e.Year, e.Month, e.Day) + "#" + e.Key
 }
 
-func (s *site) saveLink(line *irc.Line, url, title string) {
+func newLinkEntry(channel string, line *irc.Line, url, title string) linkEntry {
 	year, month, day := line.Time.Date()
-	key := line.Time.Format(time.RFC3339Nano)
-	le := linkEntry{normalizeNick(line.Nick), url, title,
-		year, int(month), day, key, line.Time}
-	data, err := json.Marshal(le)
-	if err != nil {
-		log.Println("error marshalling to json")
-		log.Println(err)
-		return
-	}
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("links"))
-		return bucket.Put([]byte(key), data)
-	})
-	if err != nil {
-		log.Fatal(err)
+	return linkEntry{
+		Nick:      normalizeNick(line.Nick),
+		URL:       url,
+		Title:     title,
+		Year:      year,
+		Month:     int(month),
+		Day:       day,
+		Key:       line.Time.Format(time.RFC3339Nano),
+		Timestamp: line.Time,
+		Channel:   channel,
 	}
 }
 
-func (s site) shortenLink(url string) string {
-	if s.BitlyAccessToken == "" {
-		// no bitly access key. can't shorten
-		return url
-	}
-	c := bitly.NewConnection(s.BitlyAccessToken)
-	bitlyLink, err := c.Shorten(url)
-	if err != nil {
-		log.Println(err)
-		// TODO: inform the user that we couldn't shorten their link
-		return url
-	}
-	return strings.Trim(bitlyLink, "\n\r ")
+func (s *site) saveLink(channel string, line *irc.Line, url, title string) error {
+	return s.storeLink(newLinkEntry(channel, line, url, title))
 }
 
-func (s site) twitterHandleFromNick(nick string) string {
-	if s.HandleFile == "" {
-		// no handle file defined, so we can't do anything
-		return ""
-	}
-	d, err := ioutil.ReadFile(s.HandleFile)
-	if err != nil {
-		log.Println("error reading handle file:", err)
-		return ""
-	}
-	lines := strings.Split(string(d), "\n")
-	mapping := map[string]string{}
-	for _, line := range lines {
-		line = strings.Trim(line, " ")
-		if line == "" {
-			continue
-		}
-		parts := strings.Split(line, ",")
-		if len(parts) == 2 {
-			mapping[parts[0]] = parts[1]
-		}
-	}
-	if handle, ok := mapping[nick]; ok {
-		return " via @" + handle
-	}
-	// not in the mapping
-	return ""
+func (s *site) storeLink(le linkEntry) error {
+	_, err := s.putLink(le, true)
+	return err
 }
 
-func (s *site) tweetLink(nick, url, title string) {
-	if s.TwitterOauthToken == "" {
-		// twitter isn't configured, so we can't tweet
-		return
-	}
-	// shorten the link
-	url = s.shortenLink(url)
-	log.Println("shortened:", url)
-
-	client := twitter.New(&oauth.Credentials{
-		s.TwitterConsumerKey,
-		s.TwitterConsumerSecret,
-	})
-	client.SetAuth(&oauth.Credentials{
-		s.TwitterOauthToken,
-		s.TwitterOauthSecret,
-	})
-	_, err := client.VerifyCredentials(nil)
-	if err != nil {
-		log.Println("twitter credentials are bad")
-		log.Println(err)
-		// TODO: let user know that credentials are bad
-		return
-	}
-	handle := s.twitterHandleFromNick(normalizeNick(nick))
-	tweet := fmt.Sprintf("%s: %s%s", url, title, handle)
-	chars := len(tweet)
-	if chars > 140 {
-		ellipsis := "..."
-		truncate := chars + len(ellipsis) - 140
-		truncatedTitle := title[:len(title)-truncate]
-		tweet = fmt.Sprintf("%s: %s via %s", url, truncatedTitle, handle)
-	}
+// like storeLink, but leaves alone anything that's already saved under
+// the same key, eg. a .url someone typed. false if there was something
+func (s *site) storeNewLink(le linkEntry) (bool, error) {
+	return s.putLink(le, false)
+}
 
-	_, err = client.Update(tweet, nil)
+func (s *site) putLink(le linkEntry, replace bool) (bool, error) {
+	data, err := json.Marshal(le)
 	if err != nil {
-		log.Println("failed to tweet")
-		log.Println(err)
-		return
+		return false, err
 	}
-}
-
-func (s site) recentLinks() []linkEntry {
-	links := []linkEntry{}
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("links"))
-		c := b.Cursor()
-		cnt := 0
-		for k, v := c.Last(); k != nil && cnt < 100; k, v = c.Prev() {
-			var le linkEntry
-			err := json.Unmarshal(v, &le)
-			if err != nil {
-				return err
-			}
-			links = append(links, le)
+	stored := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("links"))
+		if !replace && bucket.Get([]byte(le.Key)) != nil {
+			return nil
 		}
-		return nil
+		stored = true
+		return bucket.Put([]byte(le.Key), data)
 	})
-	if err != nil {
-		log.Fatal(err)
+	if err != nil || !stored {
+		return false, err
+	}
+	linksSaved.Inc()
+	// it's saved either way, and the next startup will index it
+	if err := s.indexLink(le); err != nil {
+		log.Println("couldn't index link:", err)
+		s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("meta")).Delete(linksIndexed)
+		})
 	}
-	return links
+	return true, nil
 }
 
-func (s *site) deliverMessages(nick string, conn *irc.Conn) {
+// send someone everything we've been holding for them. messages stay
+// around (marked as delivered) until they're acknowledged, so if
+// they weren't really there to get them, they'll get them again
+// next time they show up
+func (s *site) deliverMessages(nick string, conn *irc.Conn) error {
 	messages := []mention{}
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("mentions"))
-		v := b.Get([]byte(normalizeNick(nick)))
+		v := b.Get(mentionKey(nick))
 		if v == nil {
 			return nil
 		}
@@ -395,37 +638,116 @@ func (s *site) deliverMessages(nick string, conn *irc.Conn) {
 		if err != nil {
 			return err
 		}
+		now := time.Now()
+		for i := range ms.Mentions {
+			ms.Mentions[i].State = mentionDelivered
+			ms.Mentions[i].Attempts++
+			ms.Mentions[i].LastAttempt = now
+		}
 		messages = ms.Mentions
-		return nil
+		data, err := json.Marshal(ms)
+		if err != nil {
+			return err
+		}
+		return b.Put(mentionKey(nick), data)
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	if len(messages) == 0 {
-		return
+	if err != nil || len(messages) == 0 {
+		return err
 	}
 	// notify them
-	conn.Privmsg(nick, fmt.Sprintf("messages while you were out: %d", len(messages)))
+	mentionsDelivered.Add(float64(len(messages)))
+	s.outbox.privmsg(conn, nick, fmt.Sprintf("messages while you were out: %d", len(messages)))
 	for _, m := range messages {
-		conn.Privmsg(nick, fmt.Sprintf("from %s: %s", m.Nick, m.Text))
-		conn.Privmsg(nick, "<"+s.BaseURL+m.Permalink()+">")
+		s.outbox.privmsg(conn, nick, fmt.Sprintf("from %s: %s", m.Nick, m.Text))
+		if m.Key != "" {
+			s.outbox.privmsg(conn, nick, "<"+s.BaseURL+m.Permalink()+">")
+		}
+		if m.Tell && m.Attempts == 1 {
+			s.outbox.privmsg(conn, m.Nick, fmt.Sprintf("delivered your message to %s", nick))
+		}
 	}
-	// then clear them out
-	err = s.db.Update(func(tx *bolt.Tx) error {
+	s.outbox.privmsg(conn, nick, "say .ack (or anything in the channel) and I'll clear those out")
+	return nil
+}
+
+// everything we're holding for someone, delivered or not
+func (s site) messagesFor(nick string) ([]mention, error) {
+	var ms mentions
+	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("mentions"))
-		return b.Delete([]byte(normalizeNick(nick)))
+		v := b.Get(mentionKey(nick))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &ms)
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
+	return ms.Mentions, err
 }
 
-func (s *site) indexLine(line *irc.Line) {
-	le := lineEntry{normalizeNick(line.Nick), line.Text(), line.Time}
-	err := s.index.Index(le.Key(), le)
+func (s site) hasPendingMessages(nick string) (bool, error) {
+	messages, err := s.messagesFor(nick)
+	for _, m := range messages {
+		if m.State != mentionDelivered {
+			return true, err
+		}
+	}
+	return false, err
+}
 
-	log.Println(s.index.DocCount())
+// clear out the messages that we've delivered to someone. anything
+// that came in since then stays pending. returns how many were cleared
+func (s *site) acknowledgeMessages(nick string) (int, error) {
+	messages, err := s.messagesFor(nick)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
+	}
+	delivered := false
+	for _, m := range messages {
+		delivered = delivered || m.State == mentionDelivered
+	}
+	if !delivered {
+		// the usual case. don't bother with a write transaction
+		return 0, nil
+	}
+	cleared := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mentions"))
+		v := b.Get(mentionKey(nick))
+		if v == nil {
+			return nil
+		}
+		var ms mentions
+		err := json.Unmarshal(v, &ms)
+		if err != nil {
+			return err
+		}
+		remaining := []mention{}
+		for _, m := range ms.Mentions {
+			if m.State == mentionDelivered {
+				cleared++
+			} else {
+				remaining = append(remaining, m)
+			}
+		}
+		if cleared == 0 {
+			return nil
+		}
+		if len(remaining) == 0 {
+			return b.Delete(mentionKey(nick))
+		}
+		ms.Mentions = remaining
+		data, err := json.Marshal(ms)
+		if err != nil {
+			return err
+		}
+		return b.Put(mentionKey(nick), data)
+	})
+	if err != nil {
+		return 0, err
 	}
+	return cleared, nil
+}
+
+func (s *site) indexLine(le lineEntry) error {
+	return s.index.Index(le.DocID(), le)
 }
@@ -1,19 +1,58 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/boltdb/bolt"
+	irc "github.com/fluffle/goirc/client"
 )
 
+// a site backed by a throwaway bolt db and an in-memory index.
+// call the returned function to clean up afterwards
+func newTestSite(t *testing.T, channels ...string) (*site, func()) {
+	dir, err := ioutil.TempDir("", "frontdesk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexMapping, _ := buildIndexMapping()
+	index, err := bleve.NewMemOnly(indexMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSite(db, index, nil, channels, "http://example.com", "", "",
+		"", "", "", "", "")
+	// no need to be polite to the fake IRC server
+	s.outbox = newOutbox(rateLimit{rate: 1000, burst: 1000}, rateLimit{rate: 1000, burst: 1000})
+	return s, func() {
+		s.channelLogger.wait()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testLine(nick, channel, text string, ts time.Time) *irc.Line {
+	return &irc.Line{Nick: nick, Cmd: "PRIVMSG", Args: []string{channel, text}, Time: ts}
+}
+
 func Test_linkEntryFormattedTimestamp(t *testing.T) {
 	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
 	le := linkEntry{
-		"nick",
-		"http://foo.com/",
-		"a title",
-		2015, 02, 17,
-		"a-key",
-		ts,
+		Nick:  "nick",
+		URL:   "http://foo.com/",
+		Title: "a title",
+		Year:  2015, Month: 02, Day: 17,
+		Key:       "a-key",
+		Timestamp: ts,
 	}
 	if le.FormattedTimestamp() != "Sun Feb 15 12:04:36" {
 		t.Error(le.FormattedTimestamp())
@@ -23,14 +62,97 @@ func Test_linkEntryFormattedTimestamp(t *testing.T) {
 func Test_linkEntryDiscussionLink(t *testing.T) {
 	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
 	le := linkEntry{
-		"nick",
-		"http://foo.com/",
-		"a title",
-		2015, 02, 17,
-		"a-key",
-		ts,
+		Nick:  "nick",
+		URL:   "http://foo.com/",
+		Title: "a title",
+		Year:  2015, Month: 02, Day: 17,
+		Key:       "a-key",
+		Timestamp: ts,
 	}
 	if le.DiscussionLink() != "/logs/2015/02/17/#a-key" {
 		t.Error(le.DiscussionLink())
 	}
+	le.Channel = "#frontdesk"
+	if le.DiscussionLink() != "/logs/frontdesk/2015/02/17/#a-key" {
+		t.Error(le.DiscussionLink())
+	}
+}
+
+func Test_logLinePerChannel(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one", "#two")
+	defer cleanup()
+
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	s.channelLogger.logLine("#one", testLine("alice", "#one", "hello one", ts))
+	s.channelLogger.logLine("#two", testLine("bob", "#two", "hello two", ts))
+
+	lines, _ := s.linesForDay("#one", "2015", "02", "15")
+	if len(lines) != 1 || lines[0].Text != "hello one" || lines[0].Channel != "#one" {
+		t.Error("wrong lines for #one", lines)
+	}
+	lines, _ = s.linesForDay("#two", "2015", "02", "15")
+	if len(lines) != 1 || lines[0].Text != "hello two" {
+		t.Error("wrong lines for #two", lines)
+	}
+	if y, _ := s.years("#two"); len(y) != 1 || y[0] != "2015" {
+		t.Error(y)
+	}
+	if y, _ := s.years("#three"); len(y) != 0 {
+		t.Error(y)
+	}
+
+	// same timestamp, different channels, so the index IDs need to differ
+	lines, _ = s.getLines([]string{"#one " + lines[0].Key(), "#two " + lines[0].Key()})
+	if len(lines) != 2 || lines[0].Channel != "#one" || lines[1].Channel != "#two" {
+		t.Error("getLines", lines)
+	}
+	if lines[0].Permalink() != "/logs/one/2015/02/15/#2015-02-15T12:04:36.439011141-05:00" {
+		t.Error(lines[0].Permalink())
+	}
+}
+
+func Test_migrateLines(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one", "#two")
+	defer cleanup()
+
+	// an old style line, directly under lines/YYYY/MM/DD
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+	le := lineEntry{Nick: "alice", Text: "from before", Timestamp: ts}
+	data, _ := json.Marshal(le)
+	s.db.Update(func(tx *bolt.Tx) error {
+		yb, _ := tx.Bucket([]byte("lines")).CreateBucketIfNotExists([]byte("2015"))
+		mb, _ := yb.CreateBucketIfNotExists([]byte("02"))
+		db, _ := mb.CreateBucketIfNotExists([]byte("15"))
+		return db.Put([]byte(le.Key()), data)
+	})
+
+	s.migrateLines()
+	lines, _ := s.linesForDay("#one", "2015", "02", "15")
+	if len(lines) != 1 || lines[0].Text != "from before" {
+		t.Error("line wasn't migrated", lines)
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("lines")).Bucket([]byte("2015")) != nil {
+			t.Error("old bucket should be gone")
+		}
+		return nil
+	})
+	// old search index IDs were just the key
+	lines, _ = s.getLines([]string{le.Key()})
+	if len(lines) != 1 || lines[0].Channel != "#one" {
+		t.Error("old IDs should map to the default channel", lines)
+	}
+}
+
+func Test_channelForSlug(t *testing.T) {
+	s := site{channels: []string{"#One", "#two"}}
+	if c, ok := s.channelForSlug("one"); !ok || c != "#One" {
+		t.Error(c)
+	}
+	if _, ok := s.channelForSlug("three"); ok {
+		t.Error("#three isn't configured")
+	}
+	if c, ok := s.configuredChannel("#ONE"); !ok || c != "#One" {
+		t.Error(c)
+	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	irc "github.com/fluffle/goirc/client"
+)
+
+// if something has been sitting in the outbox this long, it's not
+// just rate limiting
+var outboxStuckAfter = 5 * time.Minute
+
+// health keeps track of the things the smoketest needs to know about
+// that nothing else does: which channels we're actually in, and when
+// we last heard anything from them
+type health struct {
+	// 0 means don't check for recent activity
+	window time.Duration
+
+	mu       sync.Mutex
+	joined   map[string]bool
+	lastLine time.Time
+}
+
+func newHealth(window time.Duration) *health {
+	// count starting up as activity, so we don't fail right away
+	return &health{window: window, joined: map[string]bool{}, lastLine: time.Now()}
+}
+
+// called for JOIN, PART and KICK, plus everything the channel
+// logger sees
+func (h *health) Handle(conn *irc.Conn, line *irc.Line) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	me := ""
+	if conn != nil {
+		me = conn.Me().Nick
+	}
+	switch line.Cmd {
+	case "JOIN":
+		if line.Nick == me {
+			h.joined[strings.ToLower(line.Target())] = true
+		}
+	case "PART":
+		if line.Nick == me {
+			delete(h.joined, strings.ToLower(line.Target()))
+		}
+	case "KICK":
+		if len(line.Args) > 1 && line.Args[1] == me {
+			delete(h.joined, strings.ToLower(line.Args[0]))
+		}
+	}
+	h.lastLine = time.Now()
+}
+
+// called on disconnect. we're not in anything anymore
+func (h *health) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.joined = map[string]bool{}
+}
+
+func (h *health) inChannel(channel string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.joined[strings.ToLower(channel)]
+}
+
+func (h *health) sinceLastLine(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.Sub(h.lastLine)
+}
+
+type smoketest struct {
+	name string
+	run  func() error
+}
+
+// everything /smoketest/ checks, in the order it reports them
+func (s *site) smoketests() []smoketest {
+	tests := []smoketest{
+		{"connected", s.checkConnected},
+		{"joined", s.checkJoined},
+	}
+	if s.health.window > 0 {
+		tests = append(tests, smoketest{"activity", s.checkActivity})
+	}
+	if s.nickAuth != nil && s.nickAuth.configured() {
+		tests = append(tests, smoketest{"authenticated", s.checkAuthenticated})
+	}
+	return append(tests,
+		smoketest{"storage", s.checkSpool},
+		smoketest{"bolt", s.checkBolt},
+		smoketest{"bleve", s.checkBleve},
+		smoketest{"outbox", s.checkOutbox},
+	)
+}
+
+func (s *site) checkConnected() error {
+	if s.conn == nil || !s.conn.Connected() {
+		return fmt.Errorf("not connected (%d failed attempts)", backoff)
+	}
+	return nil
+}
+
+func (s *site) checkJoined() error {
+	missing := []string{}
+	for _, c := range s.channels {
+		if !s.health.inChannel(c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("not in %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (s *site) checkActivity() error {
+	if d := s.health.sinceLastLine(time.Now()); d > s.health.window {
+		return fmt.Errorf("nothing heard for %s", d.Truncate(time.Second))
+	}
+	return nil
+}
+
+func (s *site) checkAuthenticated() error {
+	if rejected, reason := s.nickAuth.failed(); rejected {
+		return errors.New(reason)
+	}
+	return nil
+}
+
+func (s *site) checkSpool() error {
+	if n, err := s.spool.status(); n > 0 {
+		return fmt.Errorf("%d lines waiting in the spool (%s)", n, err)
+	}
+	return nil
+}
+
+// actually write something, since reads can work fine on a db
+// that won't take writes
+func (s *site) checkBolt() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("smoketest"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("last"), []byte(time.Now().Format(time.RFC3339Nano)))
+	})
+}
+
+func (s *site) checkBleve() error {
+	_, err := s.index.DocCount()
+	return err
+}
+
+func (s *site) checkOutbox() error {
+	if d := s.outbox.oldest(time.Now()); d > outboxStuckAfter {
+		return fmt.Errorf("oldest message has been waiting %s", d.Truncate(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func smoketestJSON(t *testing.T, s *site) smoketestResponse {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/smoketest/", nil)
+	r.Header.Set("Accept", "application/json")
+	smoketestHandler(w, r, s)
+	var sr smoketestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	return sr
+}
+
+func Test_smoketest(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one", "#two")
+	defer cleanup()
+	s.health = newHealth(time.Hour)
+
+	// not connected to anything yet
+	sr := smoketestJSON(t, s)
+	if sr.Status != "FAIL" || sr.TestsRun != 7 || sr.TestsFailed != 2 {
+		t.Fatal(sr)
+	}
+	if sr.FailedTests[0] != "connected: not connected (0 failed attempts)" ||
+		sr.FailedTests[1] != "joined: not in #one, #two" {
+		t.Error(sr.FailedTests)
+	}
+
+	conn, _, closeConn := newTestConn(t)
+	defer closeConn()
+	s.conn = conn
+	me := conn.Me().Nick
+	s.health.Handle(conn, &irc.Line{Cmd: "JOIN", Nick: me, Args: []string{"#one"}})
+	s.health.Handle(conn, &irc.Line{Cmd: "JOIN", Nick: "alice", Args: []string{"#two"}})
+	sr = smoketestJSON(t, s)
+	if sr.TestsFailed != 1 || sr.FailedTests[0] != "joined: not in #two" {
+		t.Error(sr.FailedTests)
+	}
+
+	s.health.Handle(conn, &irc.Line{Cmd: "JOIN", Nick: me, Args: []string{"#TWO"}})
+	sr = smoketestJSON(t, s)
+	if sr.Status != "PASS" || sr.TestsPassed != 7 || sr.Time <= 0 {
+		t.Error(sr)
+	}
+
+	// kicked out, and it's gone quiet
+	s.health.Handle(conn, &irc.Line{Cmd: "KICK", Nick: "alice", Args: []string{"#one", me, "bye"}})
+	s.health.lastLine = time.Now().Add(-2 * time.Hour)
+	sr = smoketestJSON(t, s)
+	if sr.TestsFailed != 2 || sr.FailedTests[0] != "joined: not in #one" ||
+		sr.FailedTests[1] != "activity: nothing heard for 2h0m0s" {
+		t.Error(sr.FailedTests)
+	}
+}
+
+func Test_smoketestStorage(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+
+	// something that's been waiting far too long
+	s.outbox.mu.Lock()
+	s.outbox.queue = append(s.outbox.queue, outMessage{target: "alice", text: "hi",
+		queued: time.Now().Add(-time.Hour)})
+	s.outbox.mu.Unlock()
+	s.db.Close()
+
+	failed := map[string]bool{}
+	for _, f := range smoketestJSON(t, s).FailedTests {
+		failed[strings.SplitN(f, ":", 2)[0]] = true
+	}
+	for _, name := range []string{"bolt", "outbox"} {
+		if !failed[name] {
+			t.Error(name, "should have failed")
+		}
+	}
+}
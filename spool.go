@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often we try to get spooled lines into the db
+var spoolInterval = 30 * time.Second
+
+// when a line can't be written to the db (or indexed), it goes in
+// the spool instead, a file of JSON lines next to the db, so that we
+// don't lose it. we keep replaying the spool until the db takes
+// everything in it. while there's anything in there, we're degraded
+// and the smoketest says so.
+type spool struct {
+	path string
+
+	mu      sync.Mutex
+	pending int
+	lastErr error
+}
+
+func newSpool(path string) *spool {
+	sp := &spool{path: path}
+	entries, err := sp.read()
+	if err != nil {
+		log.Println("couldn't read the spool:", err)
+	}
+	sp.pending = len(entries)
+	if sp.pending > 0 {
+		sp.lastErr = fmt.Errorf("%d lines left over from last time", sp.pending)
+	}
+	return sp
+}
+
+// hang on to a line that we couldn't store because of cause
+func (sp *spool) add(le lineEntry, cause error) error {
+	data, err := json.Marshal(le)
+	if err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	f, err := os.OpenFile(sp.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	sp.pending++
+	sp.lastErr = cause
+	log.Println("spooled a line for", le.Channel, "because:", cause)
+	return nil
+}
+
+// how many lines are waiting, and why. zero means we're healthy
+func (sp *spool) status() (int, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.pending, sp.lastErr
+}
+
+func (sp *spool) read() ([]lineEntry, error) {
+	entries := []lineEntry{}
+	f, err := os.Open(sp.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return entries, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var le lineEntry
+		if err := json.Unmarshal(scanner.Bytes(), &le); err != nil {
+			// probably half written when we went down
+			log.Println("skipping a bad line in the spool:", err)
+			continue
+		}
+		entries = append(entries, le)
+	}
+	return entries, scanner.Err()
+}
+
+// try to store everything in the spool. whatever still fails stays
+// in there for next time
+func (sp *spool) replay(store func(lineEntry) error) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.pending == 0 {
+		return nil
+	}
+	entries, err := sp.read()
+	if err != nil {
+		return err
+	}
+	failed := []lineEntry{}
+	for _, le := range entries {
+		if err := store(le); err != nil {
+			failed = append(failed, le)
+			sp.lastErr = err
+		}
+	}
+	if len(failed) == 0 {
+		log.Println("replayed", len(entries), "spooled lines")
+		sp.pending = 0
+		sp.lastErr = nil
+		return os.Remove(sp.path)
+	}
+
+	// write out what's left and swap it in
+	tmp := sp.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, le := range failed {
+		data, err := json.Marshal(le)
+		if err != nil {
+			continue
+		}
+		w.Write(append(data, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	sp.pending = len(failed)
+	return os.Rename(tmp, sp.path)
+}
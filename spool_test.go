@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_spool(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	cl := s.channelLogger
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+
+	// the db goes away
+	path := s.db.Path()
+	s.db.Close()
+	if err := cl.logLine("#one", testLine("alice", "#one", "is anyone writing this down?", ts)); err != nil {
+		t.Fatal("it should have been spooled", err)
+	}
+	if n, err := s.spool.status(); n != 1 || err == nil {
+		t.Error(n, err)
+	}
+
+	w := httptest.NewRecorder()
+	smoketestHandler(w, httptest.NewRequest("GET", "/smoketest/", nil), s)
+	if !strings.Contains(w.Body.String(), "FAILED: storage: 1 lines waiting in the spool") {
+		t.Error(w.Body.String())
+	}
+
+	// and comes back
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s.db, cl.db = db, db
+	if err := s.spool.replay(cl.persistLine); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.spool.status(); n != 0 || err != nil {
+		t.Error(n, err)
+	}
+	if _, err := os.Stat(s.spool.path); !os.IsNotExist(err) {
+		t.Error("spool should be gone", err)
+	}
+	lines, err := s.linesForDay("#one", "2015", "02", "15")
+	if err != nil || len(lines) != 1 || lines[0].Text != "is anyone writing this down?" {
+		t.Error(lines, err)
+	}
+
+	w = httptest.NewRecorder()
+	smoketestHandler(w, httptest.NewRequest("GET", "/smoketest/", nil), s)
+	if strings.Contains(w.Body.String(), "FAILED: storage") {
+		t.Error(w.Body.String())
+	}
+}
+
+func Test_spoolLeftovers(t *testing.T) {
+	f, err := ioutil.TempFile("", "frontdesk-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Nick":"alice","Text":"one","Channel":"#one"}` + "\n")
+	f.WriteString(`{"Nick":"alice","Te` + "\n")
+	f.WriteString(`{"Nick":"bob","Text":"two","Channel":"#one"}` + "\n")
+	f.Close()
+
+	sp := newSpool(f.Name())
+	if n, _ := sp.status(); n != 2 {
+		t.Error("expected the two good lines to be waiting, got", n)
+	}
+
+	// the db is still broken for bob
+	stored := []string{}
+	err = sp.replay(func(le lineEntry) error {
+		if le.Nick == "bob" {
+			return bolt.ErrDatabaseNotOpen
+		}
+		stored = append(stored, le.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0] != "one" {
+		t.Error(stored)
+	}
+	if n, err := sp.status(); n != 1 || err != bolt.ErrDatabaseNotOpen {
+		t.Error(n, err)
+	}
+	if entries, _ := sp.read(); len(entries) != 1 || entries[0].Nick != "bob" {
+		t.Error(entries)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// .tell, .tells and .untell work in the channel or in a private
+// message (in which case there's no channel)
+
+func (cl *channelLogger) tellCommand(c *commandContext) {
+	nick, err := cl.site.resolveAlias(normalizeNick(c.args[0]))
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if strings.EqualFold(nick, normalizeNick(c.line.Nick)) {
+		c.reply("you can tell yourself that")
+		return
+	}
+	m := newMention(c.channel, c.line)
+	m.Text = c.args[1]
+	m.Tell = true
+	if c.channel == "" {
+		// nothing in the logs to link to
+		m.Key = ""
+	}
+	if err := cl.storeMention(nick, m); err != nil {
+		c.fail(err)
+		return
+	}
+	c.reply(fmt.Sprintf("ok, I'll tell %s next time I see them", nick))
+}
+
+func (cl *channelLogger) tellsCommand(c *commandContext) {
+	tells, err := cl.site.queuedTells(c.line.Nick)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if len(tells) == 0 {
+		c.reply("you don't have any messages waiting to be delivered")
+		return
+	}
+	for i, t := range tells {
+		c.reply(fmt.Sprintf("%d. to %s: %s", i+1, t.To, t.Text))
+	}
+	c.reply("use .untell N to cancel one")
+}
+
+func (cl *channelLogger) untellCommand(c *commandContext) {
+	n, err := strconv.Atoi(c.args[0])
+	if err != nil || n < 1 {
+		c.reply(fmt.Sprintf("%s isn't a number I know about", c.args[0]))
+		return
+	}
+	t, ok, err := cl.site.cancelTell(c.line.Nick, n)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if !ok {
+		c.reply(fmt.Sprintf("you don't have a message %d waiting (see .tells)", n))
+		return
+	}
+	c.reply(fmt.Sprintf("ok, I won't tell %s: %s", t.To, t.Text))
+}
+
+// a .tell that hasn't been delivered yet
+type queuedTell struct {
+	To string
+	mention
+}
+
+// the undelivered .tells someone has left, in a stable order so
+// .untell can refer to them by number
+func (s site) queuedTells(from string) ([]queuedTell, error) {
+	from = normalizeNick(from)
+	tells := []queuedTell{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mentions"))
+		return b.ForEach(func(k, v []byte) error {
+			var ms mentions
+			err := json.Unmarshal(v, &ms)
+			if err != nil {
+				return err
+			}
+			for _, m := range ms.Mentions {
+				if m.Tell && m.Nick == from && m.State != mentionDelivered {
+					tells = append(tells, queuedTell{string(k), m})
+				}
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(tells, func(i, j int) bool {
+		return tells[i].Timestamp.Before(tells[j].Timestamp)
+	})
+	return tells, err
+}
+
+// remove the nth (counting from 1) of someone's queued .tells
+func (s *site) cancelTell(from string, n int) (queuedTell, bool, error) {
+	tells, err := s.queuedTells(from)
+	if err != nil || n > len(tells) {
+		return queuedTell{}, false, err
+	}
+	t := tells[n-1]
+	found := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mentions"))
+		v := b.Get([]byte(t.To))
+		if v == nil {
+			return nil
+		}
+		var ms mentions
+		err := json.Unmarshal(v, &ms)
+		if err != nil {
+			return err
+		}
+		remaining := []mention{}
+		for _, m := range ms.Mentions {
+			if !found && m.Tell && m.Nick == t.Nick && m.Timestamp.Equal(t.Timestamp) && m.Text == t.Text {
+				found = true
+				continue
+			}
+			remaining = append(remaining, m)
+		}
+		if len(remaining) == 0 {
+			return b.Delete([]byte(t.To))
+		}
+		ms.Mentions = remaining
+		data, err := json.Marshal(ms)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(t.To), data)
+	})
+	return t, found, err
+}
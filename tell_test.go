@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_tell(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	cl := s.channelLogger
+	ts, _ := time.Parse(time.RFC3339Nano, "2015-02-15T12:04:36.439011141-05:00")
+
+	cl.dispatch(conn, "#one", testLine("bob", "#one", ".tell alice_ the build is broken", ts))
+	expectLine(t, lines, "PRIVMSG bob :ok, I'll tell alice")
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".tell carol lunch?", ts.Add(time.Second)))
+	expectLine(t, lines, "PRIVMSG bob :ok, I'll tell carol")
+	cl.dispatch(conn, "#one", testLine("bob", "#one", ".tell bob hi me", ts))
+	expectLine(t, lines, "PRIVMSG bob :you can tell yourself")
+
+	tells, _ := s.queuedTells("bob")
+	if len(tells) != 2 || tells[0].To != "alice" || tells[0].Text != "the build is broken" || tells[1].To != "carol" {
+		t.Fatal(tells)
+	}
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".tells", ts))
+	if l := expectLine(t, lines, "PRIVMSG bob :1."); l != "PRIVMSG bob :1. to alice: the build is broken" {
+		t.Error(l)
+	}
+
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".untell 2", ts))
+	expectLine(t, lines, "PRIVMSG bob :ok, I won't tell carol")
+	if m, _ := s.messagesFor("carol"); len(m) != 0 {
+		t.Error(m)
+	}
+	cl.dispatch(conn, "", testLine("bob", "frontdesk", ".untell 2", ts))
+	expectLine(t, lines, "PRIVMSG bob :you don't have a message 2")
+
+	// alice is online but away. when she says something, she gets it,
+	// and bob hears that she did
+	cl.Handle(conn, testLine("alice", "#one", "back", ts.Add(time.Minute)))
+	if l := expectLine(t, lines, "PRIVMSG alice :from"); l != "PRIVMSG alice :from bob: the build is broken" {
+		t.Error(l)
+	}
+	expectLine(t, lines, "PRIVMSG bob :delivered your message to alice")
+	if tells, _ := s.queuedTells("bob"); len(tells) != 0 {
+		t.Error("delivered tells aren't queued any more", tells)
+	}
+}
+
+func Test_tellMismatchedCase(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	cl := s.channelLogger
+	now := time.Now()
+
+	cl.dispatch(conn, "#one", testLine("bob", "#one", ".tell Alice hi", now))
+	expectLine(t, lines, "PRIVMSG bob :ok, I'll tell Alice")
+	cl.dispatch(conn, "#one", testLine("bob", "#one", ".tell BOB hi me", now))
+	expectLine(t, lines, "PRIVMSG bob :you can tell yourself")
+
+	cl.Handle(conn, testLine("alice", "#one", "back", now.Add(time.Minute)))
+	if l := expectLine(t, lines, "PRIVMSG alice :from"); l != "PRIVMSG alice :from bob: hi" {
+		t.Error(l)
+	}
+}
+
+func Test_migrateMentions(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	now := time.Now()
+	// the way they used to be stored
+	s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mentions"))
+		for i, nick := range []string{"Alice", "alice", "ALICE"} {
+			data, _ := json.Marshal(mentions{[]mention{{Nick: "bob", Text: nick, Timestamp: now.Add(time.Duration(i) * time.Second)}}})
+			b.Put([]byte(nick), data)
+		}
+		return nil
+	})
+	s.migrateMentions()
+
+	m, err := s.messagesFor("aLiCe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 || m[0].Text != "Alice" || m[1].Text != "alice" || m[2].Text != "ALICE" {
+		t.Error(m)
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("mentions")).Stats().KeyN; n != 1 {
+			t.Error(n)
+		}
+		return nil
+	})
+}
@@ -16,11 +16,19 @@ var indexTemplate = `
 
 <div class="list-group">
 <a class="list-group-item" href="/links/">Recent Links</a>
+<a class="list-group-item" href="/tweets/">Tweets</a>
 <a class="list-group-item" href="/search/">Search</a>
+</div>
+
+{{ range .Channels }}
+<h2><a href="/logs/{{ .Slug }}/">{{ .Name }}</a></h2>
+<div class="list-group">
+{{ $slug := .Slug }}
 {{ range .Years }}
-<a class="list-group-item" href="/logs/{{ . }}/">Full Chat Logs {{ . }}</a>
+<a class="list-group-item" href="/logs/{{ $slug }}/{{ . }}/">Full Chat Logs {{ . }}</a>
 {{ end }}
 </div>
+{{ end }}
 </div>
 </html>
 
@@ -37,18 +45,40 @@ var dayTemplate = `
 <div class="container">
 <ol class="breadcrumb">
   <li><a href="/">Home</a></li>
-  <li><a href="/logs/{{.Year}}/">{{.Year}}</a></li>
-  <li><a href="/logs/{{.Year}}/{{.Month}}/">{{.Month}}</a></li>
+  <li><a href="/logs/{{.Slug}}/">{{.Channel}}</a></li>
+  <li><a href="/logs/{{.Slug}}/{{.Year}}/">{{.Year}}</a></li>
+  <li><a href="/logs/{{.Slug}}/{{.Year}}/{{.Month}}/">{{.Month}}</a></li>
   <li class="active">{{.Day}}</li>
 </ol>
 <h1>{{.Title}}</h1>
+<p>
+{{ if .HideNoise }}
+<a href="?">show joins/parts</a>
+{{ else }}
+<a href="?noise=hide">hide joins/parts</a>
+{{ end }}
+</p>
 <table class="table table-striped table-condensed">
 {{ range .Lines }}
+{{ if .IsMessage }}
 <tr id="{{.Key}}">
   <td><a name="{{.Key}}"></a><a href="#{{.Key}}">{{.NiceTime}}</a></td>
   <td>&lt;<b>{{.Nick}}</b>&gt;</td>
   <td><tt>{{.Text}}</tt></td>
 </tr>
+{{ else if .IsAction }}
+<tr id="{{.Key}}" class="action">
+  <td><a name="{{.Key}}"></a><a href="#{{.Key}}">{{.NiceTime}}</a></td>
+  <td></td>
+  <td><tt><i>{{.EventText}}</i></tt></td>
+</tr>
+{{ else }}
+<tr id="{{.Key}}" class="event {{.Kind}}">
+  <td><a name="{{.Key}}"></a><a href="#{{.Key}}">{{.NiceTime}}</a></td>
+  <td class="text-muted">--</td>
+  <td class="text-muted"><small>{{.EventText}}</small></td>
+</tr>
+{{ end }}
 {{ end }}
 </table>
 </div>
@@ -86,18 +116,32 @@ var searchTemplate = `
 <form action="." method="get" class="form-inline">
 <div class="form-group">
 <input type="text" name="q" value="{{.Query}}" class="form-control"/>
+<input type="hidden" name="type" value="{{.Type}}" />
 <input type="submit" value="search" class="btn btn-primary" />
 </div>
 </form>
+<ul class="nav nav-tabs">
+  <li{{ if eq .Type "lines" }} class="active"{{ end }}><a href="?q={{urlquery .Query}}">logs</a></li>
+  <li{{ if eq .Type "links" }} class="active"{{ end }}><a href="?q={{urlquery .Query}}&amp;type=links">links</a></li>
+</ul>
 <p>{{.Results.Total}} Hits</p>
 <table class="table table-striped table-condensed">
 {{ range .Lines }}
 <tr>
   <td><a href="{{.Permalink}}">{{.Timestamp.Month}} {{.Timestamp.Day}} {{.Timestamp.Year}}  {{.NiceTime}}</a></td>
+  <td>{{.Channel}}</td>
   <td>&lt;<b>{{.Nick}}</b>&gt;</td>
   <td><tt>{{.Text}}</tt></td>
 </tr>
 
+{{ end }}
+{{ range .Links }}
+<tr>
+  <td><a href="{{.URL}}">{{.Title}}</a></td>
+  <td><b><a href="/links/by/{{.Nick}}/">{{.Nick}}</a></b></td>
+  <td>{{.FormattedTimestamp}}<td>
+  <td><a href="{{.DiscussionLink}}">discussion</a></td>
+</tr>
 {{ end }}
 </table>
 
@@ -141,7 +185,8 @@ var monthTemplate = `
 <div class="container">
 <ol class="breadcrumb">
   <li><a href="/">Home</a></li>
-  <li><a href="/logs/{{.Year}}/">{{.Year}}</a></li>
+  <li><a href="/logs/{{.Slug}}/">{{.Channel}}</a></li>
+  <li><a href="/logs/{{.Slug}}/{{.Year}}/">{{.Year}}</a></li>
   <li class="active">{{.Month}}</li>
 </ol>
 <h1>{{.Title}}</h1>
@@ -163,6 +208,7 @@ var yearTemplate = `
 <div class="container">
 <ol class="breadcrumb">
   <li><a href="/">Home</a></li>
+  <li><a href="/logs/{{.Slug}}/">{{.Channel}}</a></li>
   <li class="active">{{.Year}}</li>
 </ol>
 <h1>{{.Title}}</h1>
@@ -174,29 +220,86 @@ var yearTemplate = `
 </div>
 </html>`
 
+var channelTemplate = `
+<html>
+<head>
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="//maxcdn.bootstrapcdn.com/bootstrap/3.3.1/css/bootstrap.min.css" />
+</head>
+<body>
+<div class="container">
+<ol class="breadcrumb">
+  <li><a href="/">Home</a></li>
+  <li class="active">{{.Channel}}</li>
+</ol>
+<h1>{{.Title}}</h1>
+<table class="table table-striped table-condensed">
+{{ range .Years }}
+<tr><td><a href="{{.}}/">{{.}}</a></td></tr>
+{{ end }}
+</table>
+</div>
+</html>`
+
 var linksTemplate = `
 <html>
 <head>
 <title>{{.Title}}</title>
 <link rel="stylesheet" href="//maxcdn.bootstrapcdn.com/bootstrap/3.3.1/css/bootstrap.min.css" />
+<link rel="alternate" type="application/rss+xml" href="{{.FeedURL}}" />
 </head>
 <body>
 <div class="container">
 <ol class="breadcrumb">
   <li><a href="/">Home</a></li>
-  <li class="active">Recent Links</li>
+  <li><a href="/links/">Recent Links</a></li>
 </ol>
 <h1>{{.Title}}</h1>
+<p><a href="{{.FeedURL}}">RSS</a></p>
 <table class="table table-striped table-condensed">
+{{ $clicks := .Clicks }}
 {{ range .Links }}
 <tr>
-  <td><a href="{{.URL}}">{{.Title}}</a></td>
-  <td><b>{{.Nick}}</b></td>
+  <td><a href="{{.URL}}">{{.Title}}</a>{{ if .Description }}<br /><small class="text-muted">{{.Description}}</small>{{ end }}</td>
+  <td>{{ with index $clicks .URL }}<span class="badge" title="clicks">{{.}}</span>{{ end }}</td>
+  <td><b><a href="/links/by/{{.Nick}}/">{{.Nick}}</a></b></td>
   <td>{{.FormattedTimestamp}}<td>
   <td><a href="{{.DiscussionLink}}">discussion</a></td>
 </tr>
 {{ end }}
 </table>
+{{ if .OlderURL }}
+<ul class="pager">
+  <li class="previous"><a href="{{.OlderURL}}">&larr; older</a></li>
+</ul>
+{{ end }}
+</div>
+</html>
+
+`
+
+var tweetsTemplate = `
+<html>
+<head>
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="//maxcdn.bootstrapcdn.com/bootstrap/3.3.1/css/bootstrap.min.css" />
+</head>
+<body>
+<div class="container">
+<ol class="breadcrumb">
+  <li><a href="/">Home</a></li>
+  <li class="active">Tweets</li>
+</ol>
+<h1>{{.Title}}</h1>
+<table class="table table-striped table-condensed">
+{{ range .Tweets }}
+<tr{{ if not .OK }} class="danger"{{ end }}>
+  <td>{{.Text}}{{ if .Error }}<br /><small class="text-muted">didn't go out: {{.Error}}</small>{{ end }}</td>
+  <td><b>{{.Nick}}</b></td>
+  <td>{{.FormattedTimestamp}}</td>
+</tr>
+{{ end }}
+</table>
 </div>
 </html>
 
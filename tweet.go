@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// twitter counts characters its own way: most latin-ish text counts
+// as one each, everything else (CJK, emoji, ...) counts as two, and
+// every URL counts as 23 no matter how long it is, since it gets
+// replaced with a t.co link
+const (
+	tweetMaxWeight = 280
+	tweetURLWeight = 23
+	tweetEllipsis  = "…"
+)
+
+// the ranges that count as one, from twitter-text's config
+var lightRanges = [][2]rune{
+	{0x0000, 0x10FF},
+	{0x2000, 0x200D},
+	{0x2010, 0x201F},
+	{0x2032, 0x2037},
+}
+
+func runeWeight(r rune) int {
+	switch {
+	case r == 0x200D, r == 0xFE0E, r == 0xFE0F, r >= 0x1F3FB && r <= 0x1F3FF:
+		// joiners, variation selectors and skin tones are part of
+		// the emoji before them. twitter counts a whole emoji
+		// sequence as two, so we're still on the safe side
+		return 0
+	}
+	for _, lr := range lightRanges {
+		if r >= lr[0] && r <= lr[1] {
+			return 1
+		}
+	}
+	return 2
+}
+
+// how much text (without any URLs) counts for
+func tweetWeight(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWeight(r)
+	}
+	return w
+}
+
+// what a whole status counts for, URLs and all
+func statusWeight(s string) int {
+	urls := urlPattern.FindAllString(s, -1)
+	return tweetWeight(urlPattern.ReplaceAllString(s, "")) + len(urls)*tweetURLWeight
+}
+
+// cut s down to at most max, on a word boundary if there's one
+// reasonably close, with an ellipsis on the end
+func truncateTweetText(s string, max int) string {
+	if tweetWeight(s) <= max {
+		return s
+	}
+	max -= tweetWeight(tweetEllipsis)
+	if max <= 0 {
+		return ""
+	}
+	w, cut := 0, 0
+	for i, r := range s {
+		if w+runeWeight(r) > max {
+			break
+		}
+		w += runeWeight(r)
+		cut = i + len(string(r))
+	}
+	s = s[:cut]
+	if space := strings.LastIndexFunc(s, unicode.IsSpace); space > len(s)/2 {
+		s = s[:space]
+	}
+	return strings.TrimRightFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + tweetEllipsis
+}
+
+// "<url>: <title> via @handle", with the title shortened if it
+// doesn't all fit. handle can be empty
+func composeTweet(url, title, handle string) string {
+	via := ""
+	if handle != "" {
+		via = " via @" + strings.TrimPrefix(handle, "@")
+	}
+	prefix := url + ": "
+	budget := tweetMaxWeight - tweetURLWeight - tweetWeight(": ") - tweetWeight(via)
+	title = truncateTweetText(strings.TrimSpace(title), budget)
+	if title == "" {
+		return url + via
+	}
+	return prefix + title + via
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// what twitter would count a tweet as, with every URL as 23
+func countTweet(tweet, url string) int {
+	return tweetWeight(strings.Replace(tweet, url, "", -1)) + strings.Count(tweet, url)*tweetURLWeight
+}
+
+func Test_tweetWeight(t *testing.T) {
+	cases := map[string]int{
+		"hello":   5,
+		"café":    4,
+		"日本語":     6,
+		"🎉":       2,
+		"👍🏽":      2,
+		"👩‍💻":     4,
+		"a “b” c": 7,
+	}
+	for s, expected := range cases {
+		if w := tweetWeight(s); w != expected {
+			t.Errorf("%q weighs %d, expected %d", s, w, expected)
+		}
+	}
+}
+
+func Test_composeTweet(t *testing.T) {
+	url := "http://example.com/" + strings.Repeat("long/", 40)
+
+	if tw := composeTweet("http://bit.ly/x", "A short title", ""); tw != "http://bit.ly/x: A short title" {
+		t.Error(tw)
+	}
+	if tw := composeTweet("http://bit.ly/x", "A short title", "alice"); tw != "http://bit.ly/x: A short title via @alice" {
+		t.Error(tw)
+	}
+	if tw := composeTweet("http://bit.ly/x", "A short title", "@alice"); strings.Contains(tw, "via  via") || strings.Contains(tw, "@@") {
+		t.Error(tw)
+	}
+
+	// a long URL doesn't use up any more room than a short one
+	title := strings.Repeat("word ", 40)
+	if tw := composeTweet(url, title, ""); tw != url+": "+strings.TrimSpace(title) {
+		t.Error("shouldn't have needed truncating", tw)
+	}
+
+	titles := map[string]string{
+		"ascii":    strings.Repeat("postgres vacuuming explained ", 20),
+		"emoji":    strings.Repeat("🎉 party time 🎉 ", 30),
+		"cjk":      strings.Repeat("日本語のタイトル", 30),
+		"nospaces": strings.Repeat("x", 500),
+	}
+	for name, title := range titles {
+		for _, handle := range []string{"", "somebody_with_a_long_handle"} {
+			tw := composeTweet(url, title, handle)
+			if !utf8.ValidString(tw) {
+				t.Errorf("%s: split a character: %q", name, tw)
+			}
+			if n := countTweet(tw, url); n > tweetMaxWeight || n < tweetMaxWeight-30 {
+				t.Errorf("%s: weighs %d: %q", name, n, tw)
+			}
+			if !strings.Contains(tw, tweetEllipsis) {
+				t.Errorf("%s: expected an ellipsis: %q", name, tw)
+			}
+			if handle != "" && !strings.HasSuffix(tw, "… via @"+handle) {
+				t.Errorf("%s: %q", name, tw)
+			}
+			if !strings.HasPrefix(tw, url+": ") {
+				t.Errorf("%s: %q", name, tw)
+			}
+		}
+	}
+
+	// words are kept whole where possible
+	tw := composeTweet(url, titles["ascii"], "")
+	if !strings.HasSuffix(tw, "explained…") && !strings.HasSuffix(tw, "vacuuming…") && !strings.HasSuffix(tw, "postgres…") {
+		t.Error(tw)
+	}
+}
+
+func Test_composeTweetNoRoom(t *testing.T) {
+	// a handle so long there's no room for a title at all
+	handle := strings.Repeat("h", 300)
+	if tw := composeTweet("http://bit.ly/x", "title", handle); tw != "http://bit.ly/x via @"+handle {
+		t.Error(tw)
+	}
+}
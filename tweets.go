@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// .tweet lets the people on a short list (from the config) post
+// whatever they like to the channel's twitter account. it's a two step
+// thing, so a typo doesn't go straight out: ".tweet some text" holds
+// on to it and ".tweet confirm" sends it.
+//
+// everything we send, or try to, goes in the "tweets" bucket, keyed by
+// time, along with who sent it.
+
+// how long a tweet waits for confirmation before it's forgotten
+const tweetConfirmWithin = 10 * time.Minute
+
+type tweetEntry struct {
+	Nick      string    `json:"nick"`
+	Channel   string    `json:"channel,omitempty"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (e tweetEntry) FormattedTimestamp() string {
+	return e.Timestamp.Format("Mon Jan 2 15:04:05")
+}
+
+type pendingTweet struct {
+	text    string
+	channel string
+	queued  time.Time
+}
+
+type tweeters struct {
+	site  *site
+	nicks []string
+	// sends it. nil if there's no twitter account set up
+	post func(text string) error
+
+	mu      sync.Mutex
+	pending map[string]pendingTweet
+}
+
+func newTweeters(s *site, nicks []string) *tweeters {
+	t := &tweeters{site: s, nicks: nicks, pending: map[string]pendingTweet{}}
+	if s.TwitterOauthToken != "" {
+		t.post = s.postTweet
+	}
+	return t
+}
+
+func (t *tweeters) allowed(nick string) bool {
+	for _, n := range t.nicks {
+		if strings.EqualFold(normalizeNick(nick), n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tweeters) queue(nick, channel, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[strings.ToLower(nick)] = pendingTweet{text: text, channel: channel, queued: time.Now()}
+}
+
+// takes the tweet waiting on nick, if there is one that's still fresh
+func (t *tweeters) take(nick string) (pendingTweet, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := strings.ToLower(nick)
+	p, ok := t.pending[k]
+	delete(t.pending, k)
+	if ok && time.Since(p.queued) > tweetConfirmWithin {
+		return p, false
+	}
+	return p, ok
+}
+
+// send it and write down how it went. the error is twitter's, if it
+// didn't go out
+func (t *tweeters) send(nick string, p pendingTweet) error {
+	e := tweetEntry{Nick: nick, Channel: p.channel, Text: p.text, Timestamp: time.Now(), OK: true}
+	err := t.post(p.text)
+	if err != nil {
+		e.OK, e.Error = false, err.Error()
+	}
+	data, merr := json.Marshal(e)
+	if merr != nil {
+		log.Println("couldn't record tweet:", merr)
+		return err
+	}
+	if uerr := t.site.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("tweets")).Put([]byte(e.Timestamp.Format(time.RFC3339Nano)), data)
+	}); uerr != nil {
+		log.Println("couldn't record tweet:", uerr)
+	}
+	return err
+}
+
+// up to n tweets, newest first
+func (s site) recentTweets(n int) ([]tweetEntry, error) {
+	entries := []tweetEntry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("tweets")).Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < n; k, v = c.Prev() {
+			var e tweetEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (cl *channelLogger) tweetCommand(c *commandContext) {
+	t := cl.site.tweeters
+	if t.post == nil {
+		c.reply("there's no twitter account set up")
+		return
+	}
+	switch strings.TrimSpace(c.args[0]) {
+	case "confirm":
+		p, ok := t.take(c.line.Nick)
+		if !ok {
+			c.reply("there's nothing waiting to be tweeted. say .tweet your text first")
+			return
+		}
+		if err := t.send(c.line.Nick, p); err != nil {
+			log.Println("couldn't tweet:", err)
+			c.reply("sorry, twitter didn't take it: " + err.Error())
+			return
+		}
+		c.reply("ok, tweeted")
+	case "cancel":
+		if _, ok := t.take(c.line.Nick); !ok {
+			c.reply("there's nothing waiting to be tweeted")
+			return
+		}
+		c.reply("ok, forgotten")
+	default:
+		text := strings.TrimSpace(c.args[0])
+		if w := statusWeight(text); w > tweetMaxWeight {
+			c.reply(fmt.Sprintf("that's too long for a tweet (%d, and the most is %d)", w, tweetMaxWeight))
+			return
+		}
+		t.queue(c.line.Nick, c.channel, text)
+		c.reply(fmt.Sprintf("about to tweet \"%s\". say .tweet confirm to send it or .tweet cancel to forget it", text))
+	}
+}
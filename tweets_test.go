@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_tweetCommand(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	s.ops = newOps(s, nil)
+	s.tweeters = newTweeters(s, []string{"alice"})
+	conn, lines, closeConn := newTestConn(t)
+	defer closeConn()
+	now := time.Now()
+	cl := s.channelLogger
+	identified := func(nick string) {
+		expectLine(t, lines, "WHOIS "+nick)
+		s.ops.Handle(conn, whoisReply("330", nick, nick, "is logged in as"))
+		s.ops.Handle(conn, whoisReply("318", nick, "End of /WHOIS list."))
+	}
+
+	cl.dispatch(conn, "#one", testLine("mallory", "#one", ".tweet hello", now))
+	expectLine(t, lines, "PRIVMSG mallory :sorry, you're not on the list for .tweet")
+
+	// no twitter account yet
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".tweet hello", now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :there's no twitter account set up")
+
+	sent := []string{}
+	fail := false
+	s.tweeters.post = func(text string) error {
+		if fail {
+			return errors.New("over capacity")
+		}
+		sent = append(sent, text)
+		return nil
+	}
+
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".tweet confirm", now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :there's nothing waiting to be tweeted")
+
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".tweet "+strings.Repeat("x", 281), now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :that's too long for a tweet (281, and the most is 280)")
+
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".tweet we're at http://example.com/"+strings.Repeat("x", 300), now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :about to tweet")
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".tweet cancel", now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :ok, forgotten")
+
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".tweet the meetup is on", now))
+	identified("alice")
+	expectLine(t, lines, `PRIVMSG alice :about to tweet "the meetup is on"`)
+	cl.dispatch(conn, "#one", testLine("alice", "#one", ".tweet confirm", now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :ok, tweeted")
+	if len(sent) != 1 || sent[0] != "the meetup is on" {
+		t.Error(sent)
+	}
+
+	fail = true
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".tweet second try", now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :about to tweet")
+	cl.dispatch(conn, "", testLine("alice", "frontdesk", ".tweet confirm", now))
+	identified("alice")
+	expectLine(t, lines, "PRIVMSG alice :sorry, twitter didn't take it: over capacity")
+	cl.wait()
+
+	entries, err := s.recentTweets(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatal(entries)
+	}
+	if entries[0].Text != "second try" || entries[0].OK || entries[0].Error != "over capacity" || entries[0].Channel != "" {
+		t.Error(entries[0])
+	}
+	if entries[1].Text != "the meetup is on" || !entries[1].OK || entries[1].Nick != "alice" || entries[1].Channel != "#one" {
+		t.Error(entries[1])
+	}
+
+	w := httptest.NewRecorder()
+	tweetsHandler(w, httptest.NewRequest("GET", "/tweets/", nil), s)
+	body := w.Body.String()
+	if !strings.Contains(body, "the meetup is on") || !strings.Contains(body, "didn't go out: over capacity") {
+		t.Error(body)
+	}
+}
+
+func Test_pendingTweetsExpire(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	tw := newTweeters(s, []string{"alice"})
+	tw.queue("Alice", "#one", "hello")
+	if p, ok := tw.take("alice"); !ok || p.text != "hello" {
+		t.Error("should have been waiting", p)
+	}
+	if _, ok := tw.take("alice"); ok {
+		t.Error("should only be taken once")
+	}
+	tw.queue("alice", "#one", "hello")
+	tw.pending["alice"] = pendingTweet{text: "hello", queued: time.Now().Add(-tweetConfirmWithin - time.Minute)}
+	if _, ok := tw.take("alice"); ok {
+		t.Error("should have expired")
+	}
+	if !tw.allowed("Alice_") || tw.allowed("bob") {
+		t.Error("allowlist")
+	}
+}
@@ -4,22 +4,31 @@ import (
 	"encoding/json"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 	irc "github.com/fluffle/goirc/client"
 )
 
+// how often we ask for NAMES to make sure we haven't missed anything.
+// JOIN/PART/etc. keep us up to date in between
+var namesInterval = 10 * time.Minute
+
 type userLogger struct {
 	db      *bolt.DB
 	conn    *irc.Conn
-	channel string
 	site    *site
 	running bool
+
+	// NAMES replies can span several 353 lines, so we collect them
+	// here until the 366 that ends them
+	mu    sync.Mutex
+	names map[string][]string
 }
 
-func newUserLogger(db *bolt.DB, conn *irc.Conn, channel string, site *site) *userLogger {
-	ul := &userLogger{db, conn, channel, site, false}
+func newUserLogger(db *bolt.DB, conn *irc.Conn, site *site) *userLogger {
+	ul := &userLogger{db: db, conn: conn, site: site, names: map[string][]string{}}
 	go ul.run()
 	return ul
 }
@@ -28,51 +37,197 @@ type nickEntry struct {
 	Timestamp time.Time
 }
 
-// called when we get a 353 response
+// called for JOIN, PART, QUIT, KICK, NICK and NAMES replies
 func (cl *userLogger) Handle(conn *irc.Conn, line *irc.Line) {
-	previous := cl.site.onlineNicks()
-	e := nickEntry{line.Time}
-
-	data, err := json.Marshal(e)
+	var err error
+	switch line.Cmd {
+	case "353":
+		// args are: our nick, channel type, channel, names
+		if len(line.Args) < 4 {
+			return
+		}
+		channel, ok := cl.site.configuredChannel(line.Args[2])
+		if !ok {
+			return
+		}
+		cl.mu.Lock()
+		for _, n := range strings.Fields(line.Args[3]) {
+			// strip any op/voice prefixes
+			cl.names[channel] = append(cl.names[channel], strings.TrimLeft(n, "@+%~&"))
+		}
+		cl.mu.Unlock()
+	case "366":
+		// end of NAMES. args are: our nick, channel
+		if len(line.Args) < 2 {
+			return
+		}
+		channel, ok := cl.site.configuredChannel(line.Args[1])
+		if !ok {
+			return
+		}
+		cl.mu.Lock()
+		names := cl.names[channel]
+		delete(cl.names, channel)
+		cl.mu.Unlock()
+		err = cl.update(conn, line.Time, func(c string, nicks []string) []string {
+			if c != channel {
+				return nicks
+			}
+			return names
+		})
+	case "JOIN":
+		channel, ok := cl.site.configuredChannel(line.Target())
+		if !ok {
+			return
+		}
+		err = cl.update(conn, line.Time, func(c string, nicks []string) []string {
+			if c != channel || containsNick(nicks, line.Nick) {
+				return nicks
+			}
+			return append(nicks, line.Nick)
+		})
+	case "PART":
+		channel, ok := cl.site.configuredChannel(line.Target())
+		if !ok {
+			return
+		}
+		err = cl.update(conn, line.Time, func(c string, nicks []string) []string {
+			if c != channel {
+				return nicks
+			}
+			return removeNick(nicks, line.Nick)
+		})
+	case "KICK":
+		// args are: channel, kicked nick, reason
+		if len(line.Args) < 2 {
+			return
+		}
+		channel, ok := cl.site.configuredChannel(line.Args[0])
+		if !ok {
+			return
+		}
+		err = cl.update(conn, line.Time, func(c string, nicks []string) []string {
+			if c != channel {
+				return nicks
+			}
+			return removeNick(nicks, line.Args[1])
+		})
+	case "QUIT":
+		channels := []string{}
+		err = cl.update(conn, line.Time, func(c string, nicks []string) []string {
+			if containsNick(nicks, line.Nick) {
+				channels = append(channels, c)
+			}
+			return removeNick(nicks, line.Nick)
+		})
+		for _, c := range channels {
+			if err := cl.site.channelLogger.logEvent(c, kindQuit, line.Nick, line.Text(), line.Time); err != nil {
+				log.Println(err)
+			}
+		}
+	case "NICK":
+		newNick := line.Text()
+		channels := []string{}
+		err = cl.update(conn, line.Time, func(c string, nicks []string) []string {
+			if !containsNick(nicks, line.Nick) {
+				return nicks
+			}
+			channels = append(channels, c)
+			return append(removeNick(nicks, line.Nick), newNick)
+		})
+		for _, c := range channels {
+			if err := cl.site.channelLogger.logEvent(c, kindNick, line.Nick, newNick, line.Time); err != nil {
+				log.Println(err)
+			}
+		}
+	}
 	if err != nil {
-		log.Println("error marshalling to json")
-		log.Println(err)
-		return
+		log.Println("couldn't update who's online:", err)
 	}
-	nicks := strings.Split(line.Text(), " ")
+}
+
+func containsNick(nicks []string, nick string) bool {
 	for _, n := range nicks {
-		_, ok := previous[normalizeNick(n)]
-		if !ok {
-			log.Println(n, "has entered the channel")
-			cl.site.deliverMessages(n, conn)
+		if strings.EqualFold(n, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeNick(nicks []string, nick string) []string {
+	out := []string{}
+	for _, n := range nicks {
+		if !strings.EqualFold(n, nick) {
+			out = append(out, n)
 		}
 	}
+	return out
+}
+
+// change who's online. f is given each channel's current nicks and
+// returns the new list. all of them get their last seen time updated,
+// and anyone who wasn't around before but is now gets their messages
+func (cl *userLogger) update(conn *irc.Conn, ts time.Time, f func(channel string, nicks []string) []string) error {
+	previous, err := cl.site.onlineNicks()
+	if err != nil {
+		return err
+	}
+	e := nickEntry{ts}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	arrived := []string{}
 	err = cl.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("nicks"))
+		online := tx.Bucket([]byte("online"))
 
-		for _, n := range nicks {
-			err = bucket.Put([]byte(normalizeNick(n)), data)
+		for _, channel := range cl.site.channels {
+			nicks := []string{}
+			if v := online.Get([]byte(channel)); len(v) > 0 {
+				nicks = strings.Split(string(v), " ")
+			}
+			nicks = f(channel, nicks)
+			for _, n := range nicks {
+				err = bucket.Put([]byte(normalizeNick(n)), data)
+				if err != nil {
+					return err
+				}
+				if !previous[normalizeNick(n)] {
+					previous[normalizeNick(n)] = true
+					arrived = append(arrived, n)
+				}
+			}
+			err = online.Put([]byte(channel), []byte(strings.Join(nicks, " ")))
 			if err != nil {
 				return err
 			}
 		}
-
-		online := tx.Bucket([]byte("online"))
-		err = online.Put([]byte("now"), []byte(strings.Join(nicks, " ")))
-		return err
+		return nil
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	for _, n := range arrived {
+		log.Println(n, "has entered the channel")
+		if err := cl.site.deliverMessages(n, conn); err != nil {
+			log.Println("couldn't deliver messages to", n, err)
+		}
+	}
+	return nil
 }
 
 func (cl *userLogger) run() {
 	for {
 		if cl.running && cl.conn != nil {
 			// request list of current nicks
-			cl.conn.Raw("NAMES" + " " + cl.channel)
+			for _, channel := range cl.site.channels {
+				cl.conn.Raw("NAMES" + " " + channel)
+			}
 		}
-		time.Sleep(60 * time.Second)
+		time.Sleep(namesInterval)
 	}
 }
 
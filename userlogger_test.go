@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	irc "github.com/fluffle/goirc/client"
+)
+
+func onlineIn(s *site, channel string) string {
+	var nicks []string
+	s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("online")).Get([]byte(channel))
+		if len(v) > 0 {
+			nicks = strings.Split(string(v), " ")
+		}
+		return nil
+	})
+	sort.Strings(nicks)
+	return strings.Join(nicks, " ")
+}
+
+func Test_userLoggerEvents(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one", "#two")
+	defer cleanup()
+	ul := s.userLogger
+	now := time.Now()
+
+	ul.Handle(nil, &irc.Line{Cmd: "JOIN", Nick: "alice", Args: []string{"#one"}, Time: now})
+	ul.Handle(nil, &irc.Line{Cmd: "JOIN", Nick: "bob", Args: []string{"#one"}, Time: now})
+	ul.Handle(nil, &irc.Line{Cmd: "JOIN", Nick: "bob", Args: []string{"#two"}, Time: now})
+	ul.Handle(nil, &irc.Line{Cmd: "JOIN", Nick: "carol", Args: []string{"#elsewhere"}, Time: now})
+	if o := onlineIn(s, "#one"); o != "alice bob" {
+		t.Error(o)
+	}
+	if o := onlineIn(s, "#two"); o != "bob" {
+		t.Error(o)
+	}
+
+	ul.Handle(nil, &irc.Line{Cmd: "PART", Nick: "alice", Args: []string{"#one"}, Time: now})
+	if o := onlineIn(s, "#one"); o != "bob" {
+		t.Error(o)
+	}
+	if online, _ := s.onlineNicks(); online["alice"] {
+		t.Error("alice left")
+	}
+
+	ul.Handle(nil, &irc.Line{Cmd: "NICK", Nick: "bob", Args: []string{"robert"}, Time: now})
+	if o := onlineIn(s, "#one") + "," + onlineIn(s, "#two"); o != "robert,robert" {
+		t.Error(o)
+	}
+
+	ul.Handle(nil, &irc.Line{Cmd: "KICK", Nick: "op", Args: []string{"#two", "robert", "bye"}, Time: now})
+	if o := onlineIn(s, "#two"); o != "" {
+		t.Error(o)
+	}
+
+	ul.Handle(nil, &irc.Line{Cmd: "QUIT", Nick: "robert", Args: []string{"gone"}, Time: now})
+	if o := onlineIn(s, "#one"); o != "" {
+		t.Error(o)
+	}
+
+	// everyone we've seen is known, even after they leave
+	known, _ := s.allKnownNicks()
+	sort.Strings(known)
+	if strings.Join(known, " ") != "alice bob robert" {
+		t.Error(known)
+	}
+}
+
+func Test_userLoggerNames(t *testing.T) {
+	s, cleanup := newTestSite(t, "#one")
+	defer cleanup()
+	ul := s.userLogger
+	now := time.Now()
+
+	ul.Handle(nil, &irc.Line{Cmd: "JOIN", Nick: "ghost", Args: []string{"#one"}, Time: now})
+
+	// NAMES can come back over several lines
+	ul.Handle(nil, &irc.Line{Cmd: "353", Args: []string{"frontdesk", "=", "#one", "@alice +bob"}, Time: now})
+	ul.Handle(nil, &irc.Line{Cmd: "353", Args: []string{"frontdesk", "=", "#one", "carol frontdesk"}, Time: now})
+	if o := onlineIn(s, "#one"); o != "ghost" {
+		t.Error("shouldn't change until the end of NAMES", o)
+	}
+	ul.Handle(nil, &irc.Line{Cmd: "366", Args: []string{"frontdesk", "#one", "End of /NAMES list."}, Time: now})
+	if o := onlineIn(s, "#one"); o != "alice bob carol frontdesk" {
+		t.Error(o)
+	}
+}
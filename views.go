@@ -3,49 +3,136 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"log"
 	"net/http"
 	"strings"
-	"text/template"
+	texttemplate "text/template"
+	"time"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/blevesearch/bleve"
 	"github.com/gorilla/feeds"
 )
 
-type indexPage struct {
-	Title string
+type channelLink struct {
+	Name  string
+	Slug  string
 	Years []string
 }
 
+type indexPage struct {
+	Title    string
+	Channels []channelLink
+}
+
+// the db let us down. that shouldn't take the rest of the site
+// with it
+func serverError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, "something went wrong, sorry", 500)
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	channels := []channelLink{}
+	for _, c := range s.channels {
+		years, err := s.years(c)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		channels = append(channels, channelLink{c, channelSlug(c), years})
+	}
 	p := indexPage{
-		Title: "front desk",
-		Years: s.years(),
+		Title:    "front desk",
+		Channels: channels,
 	}
 	t, _ := template.New("index").Parse(indexTemplate)
 	t.Execute(w, p)
 }
 
 type linksPage struct {
-	Title string
-	Links []linkEntry
+	Title    string
+	Links    []linkEntry
+	FeedURL  string
+	OlderURL string
+	// clicks through our own short links, by URL
+	Clicks map[string]int
+}
+
+// the filter for a links page or feed. /links/by/<nick>/ is the same
+// as ?nick=<nick>
+func linksRequest(w http.ResponseWriter, r *http.Request, prefix string) (linkFilter, int, bool) {
+	f, err := parseLinkFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return f, 0, false
+	}
+	if nick := strings.TrimPrefix(r.URL.Path, prefix+"by/"); nick != r.URL.Path {
+		f.Nick = normalizeNick(strings.Trim(nick, "/"))
+	}
+	limit, ok := formLimit(r, "limit", linksPerPage)
+	if !ok {
+		http.Error(w, "bad limit", 400)
+	}
+	return f, limit, ok
 }
 
 func linksHandler(w http.ResponseWriter, r *http.Request, s *site) {
-	recentLinks := s.recentLinks()
+	f, limit, ok := linksRequest(w, r, "/links/")
+	if !ok {
+		return
+	}
+	links, next, err := s.links(f, r.FormValue("before"), limit)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	clicks, err := s.shortLinkClicks(links)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 	p := linksPage{
-		Title: "front desk: links",
-		Links: recentLinks,
+		Title:   strings.TrimSpace("front desk: links " + f.String()),
+		Links:   links,
+		FeedURL: "/links/feed/",
+		Clicks:  clicks,
+	}
+	if q := f.query().Encode(); q != "" {
+		p.FeedURL += "?" + q
+	}
+	if next != "" {
+		q := r.URL.Query()
+		q.Set("before", next)
+		p.OlderURL = r.URL.EscapedPath() + "?" + q.Encode()
 	}
 	t, _ := template.New("links").Parse(linksTemplate)
 	t.Execute(w, p)
 }
 
+type tweetsPage struct {
+	Title  string
+	Tweets []tweetEntry
+}
+
+func tweetsHandler(w http.ResponseWriter, r *http.Request, s *site) {
+	entries, err := s.recentTweets(linksPerPage)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	t, _ := template.New("tweets").Parse(tweetsTemplate)
+	t.Execute(w, tweetsPage{Title: "front desk: tweets", Tweets: entries})
+}
+
 type searchResultsPage struct {
 	Title   string
 	Query   string
+	Type    string
 	Results *bleve.SearchResult
 	Lines   []lineEntry
+	Links   []linkEntry
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request, s *site) {
@@ -53,25 +140,21 @@ func searchHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	maxResults := 50
 
 	if q != "" {
-		query := bleve.NewQueryStringQuery(q)
-		searchRequest := bleve.NewSearchRequest(query)
-		searchResult, _ := s.index.Search(searchRequest)
-
-		keys := []string{}
-		for i, m := range searchResult.Hits {
-			if i >= maxResults {
-				break
-			}
-			keys = append(keys, m.ID)
-		}
-
-		lines := s.getLines(keys)
-
 		p := searchResultsPage{
-			Title:   fmt.Sprintf("search results for \"%s\"", q),
-			Query:   q,
-			Results: searchResult,
-			Lines:   lines,
+			Title: fmt.Sprintf("search results for \"%s\"", q),
+			Query: q,
+			Type:  "lines",
+		}
+		var err error
+		if r.FormValue("type") == "links" {
+			p.Type = "links"
+			p.Results, p.Links, err = s.searchLinks(q, maxResults, 0)
+		} else {
+			p.Results, p.Lines, err = s.searchLines(q, maxResults, 0)
+		}
+		if err != nil {
+			serverError(w, err)
+			return
 		}
 		t, _ := template.New("search").Parse(searchTemplate)
 		t.Execute(w, p)
@@ -82,14 +165,26 @@ func searchHandler(w http.ResponseWriter, r *http.Request, s *site) {
 }
 
 func linksFeedHandler(w http.ResponseWriter, r *http.Request, s *site) {
-	recentLinks := s.recentLinks()
+	f, limit, ok := linksRequest(w, r, "/links/feed/")
+	if !ok {
+		return
+	}
+	recentLinks, _, err := s.links(f, r.FormValue("before"), limit)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 	if len(recentLinks) == 0 {
 		http.Error(w, "no links", 404)
 		return
 	}
+	link := s.BaseURL + "/links/feed/"
+	if q := f.query().Encode(); q != "" {
+		link += "?" + q
+	}
 	feed := &feeds.Feed{
-		Title:       "Frontdesk Links",
-		Link:        &feeds.Link{Href: s.BaseURL + "/links/feed/"},
+		Title:       strings.TrimSpace("Frontdesk Links " + f.String()),
+		Link:        &feeds.Link{Href: link},
 		Description: "Links Feed",
 		Created:     recentLinks[0].Timestamp,
 	}
@@ -109,79 +204,161 @@ func linksFeedHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	fmt.Fprintf(w, atom)
 }
 
-func logsHandlerCore(w http.ResponseWriter, s *site, parts []string) {
-	if len(parts) == 4 {
-		yearView(w, s, parts[2])
+func logsHandlerCore(w http.ResponseWriter, r *http.Request, s *site, parts []string) {
+	// parts[0] is empty, parts[1] is "logs", and the trailing
+	// slash leaves an empty one on the end
+	if len(parts) < 4 {
+		http.Error(w, "bad request", 400)
+		return
+	}
+	channel, ok := s.channelForSlug(parts[2])
+	if ok {
+		parts = parts[3:]
+	} else if isYear(parts[2]) {
+		// an old URL from before we logged multiple channels
+		channel = s.defaultChannel()
+		parts = parts[2:]
+	} else {
+		http.Error(w, "no such channel", 404)
+		return
+	}
+	if len(parts) == 1 {
+		channelView(w, s, channel)
 		return
 	}
-	if len(parts) == 5 {
-		monthView(w, s, parts[2], parts[3])
+	if len(parts) == 2 {
+		yearView(w, s, channel, parts[0])
 		return
 	}
-	if len(parts) == 6 {
-		dayView(w, s, parts[2], parts[3], parts[4])
+	if len(parts) == 3 {
+		monthView(w, s, channel, parts[0], parts[1])
+		return
+	}
+	if len(parts) == 4 {
+		dayView(w, s, channel, parts[0], parts[1], parts[2], r.FormValue("noise") == "hide")
 		return
 	}
 	http.Error(w, "bad request", 400)
 }
 
 func logsHandler(w http.ResponseWriter, r *http.Request, s *site) {
-	logsHandlerCore(w, s, strings.Split(r.URL.String(), "/"))
+	logsHandlerCore(w, r, s, strings.Split(r.URL.Path, "/"))
 }
 
 func logsAuthHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest, s *site) {
-	logsHandlerCore(w, s, strings.Split(r.URL.String(), "/"))
+	logsHandlerCore(w, &r.Request, s, strings.Split(r.URL.Path, "/"))
+}
+
+type channelPage struct {
+	Title   string
+	Channel string
+	Slug    string
+	Years   []string
+}
+
+func channelView(w http.ResponseWriter, s *site, channel string) {
+	years, err := s.years(channel)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	p := channelPage{
+		Title:   channel,
+		Channel: channel,
+		Slug:    channelSlug(channel),
+		Years:   years,
+	}
+	t, _ := template.New("channel").Parse(channelTemplate)
+	t.Execute(w, p)
 }
 
 type yearPage struct {
-	Title  string
-	Year   string
-	Months []string
+	Title   string
+	Channel string
+	Slug    string
+	Year    string
+	Months  []string
 }
 
-func yearView(w http.ResponseWriter, s *site, year string) {
+func yearView(w http.ResponseWriter, s *site, channel, year string) {
+	months, err := s.monthsForYear(channel, year)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 	p := yearPage{
-		Title:  year,
-		Year:   year,
-		Months: s.monthsForYear(year),
+		Title:   fmt.Sprintf("%s %s", channel, year),
+		Channel: channel,
+		Slug:    channelSlug(channel),
+		Year:    year,
+		Months:  months,
 	}
 	t, _ := template.New("year").Parse(yearTemplate)
 	t.Execute(w, p)
 }
 
 type monthPage struct {
-	Title string
-	Year  string
-	Month string
-	Days  []string
+	Title   string
+	Channel string
+	Slug    string
+	Year    string
+	Month   string
+	Days    []string
 }
 
-func monthView(w http.ResponseWriter, s *site, year, month string) {
+func monthView(w http.ResponseWriter, s *site, channel, year, month string) {
+	days, err := s.daysForMonth(channel, year, month)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 	p := monthPage{
-		Title: fmt.Sprintf("%s-%s", year, month),
-		Year:  year,
-		Month: month,
-		Days:  s.daysForMonth(year, month),
+		Title:   fmt.Sprintf("%s %s-%s", channel, year, month),
+		Channel: channel,
+		Slug:    channelSlug(channel),
+		Year:    year,
+		Month:   month,
+		Days:    days,
 	}
 	t, _ := template.New("month").Parse(monthTemplate)
 	t.Execute(w, p)
 }
 
 type dayPage struct {
-	Title string
-	Year  string
-	Month string
-	Day   string
-	Lines []lineEntry
+	Title     string
+	Channel   string
+	Slug      string
+	Year      string
+	Month     string
+	Day       string
+	HideNoise bool
+	Lines     []lineEntry
 }
 
-func dayView(w http.ResponseWriter, s *site, year, month, day string) {
+func dayView(w http.ResponseWriter, s *site, channel, year, month, day string, hideNoise bool) {
+	lines, err := s.linesForDay(channel, year, month, day)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if hideNoise {
+		filtered := []lineEntry{}
+		for _, l := range lines {
+			if !l.IsMembership() {
+				filtered = append(filtered, l)
+			}
+		}
+		lines = filtered
+	}
 	p := dayPage{
-		Title: fmt.Sprintf("%s-%s-%s", year, month, day),
-		Year:  year,
-		Month: month,
-		Day:   day,
-		Lines: s.linesForDay(year, month, day),
+		Title:     fmt.Sprintf("%s %s-%s-%s", channel, year, month, day),
+		Channel:   channel,
+		Slug:      channelSlug(channel),
+		Year:      year,
+		Month:     month,
+		Day:       day,
+		HideNoise: hideNoise,
+		Lines:     lines,
 	}
 	t, _ := template.New("day").Parse(dayTemplate)
 	t.Execute(w, p)
@@ -200,23 +377,32 @@ type smoketestResponse struct {
 }
 
 func smoketestHandler(w http.ResponseWriter, r *http.Request, s *site) {
-	var status string
-	var tests int
-	if backoff == 0 {
-		status = "PASS"
-		tests = 1
-	} else {
+	failed := []string{}
+	tests := s.smoketests()
+	var elapsed time.Duration
+	for _, st := range tests {
+		start := time.Now()
+		err := st.run()
+		elapsed += time.Since(start)
+		if err != nil {
+			failed = append(failed, st.name+": "+err.Error())
+		}
+	}
+	status := "PASS"
+	if len(failed) > 0 {
 		status = "FAIL"
-		tests = 0
 	}
+	run := len(tests)
 	sr := smoketestResponse{
 		Status:       status,
 		TestClasses:  1,
-		TestsRun:     1,
-		TestsPassed:  tests,
-		TestsFailed:  1 - tests,
+		TestsRun:     run,
+		TestsPassed:  run - len(failed),
+		TestsFailed:  len(failed),
 		TestsErrored: 0,
-		Time:         1.0,
+		Time:         float64(elapsed) / float64(time.Millisecond),
+		ErroredTests: []string{},
+		FailedTests:  failed,
 	}
 
 	h := r.Header.Get("Accept")
@@ -228,13 +414,15 @@ func smoketestHandler(w http.ResponseWriter, r *http.Request, s *site) {
 	}
 	smokeTemplate := `{{.Status}}
 test classes: 1
-tests run: 1
+tests run: {{.TestsRun}}
 tests passed: {{.TestsPassed}}
 tests failed: {{.TestsFailed}}
 tests errored: 0
-time: 1.0ms
-`
-	t, _ := template.New("smoketest").Parse(smokeTemplate)
+time: {{printf "%.3f" .Time}}ms
+{{ range .FailedTests }}FAILED: {{ . }}
+{{ end }}`
+	// plain text, so nothing to escape
+	t, _ := texttemplate.New("smoketest").Parse(smokeTemplate)
 	w.Header().Set("Content-Type", "text/plain")
 	t.Execute(w, sr)
 }